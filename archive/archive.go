@@ -0,0 +1,260 @@
+// Package archive provides a small format-agnostic abstraction over tar and
+// cpio (newc) archives, so that metatar can convert between the two while
+// re-using the same include/exclude glob rules it already applies to tar
+// archives.
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"archive/tar"
+
+	"github.com/surma/gocpio"
+)
+
+// Format identifies an archive container format.
+type Format int
+
+// Supported archive formats. FormatAuto means "detect from the data".
+const (
+	FormatAuto Format = iota
+	FormatTar
+	FormatCPIO
+)
+
+// ParseFormat turns a --format flag value ("tar", "cpio" or "auto") into a Format.
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "", "auto":
+		return FormatAuto, nil
+	case "tar":
+		return FormatTar, nil
+	case "cpio":
+		return FormatCPIO, nil
+	default:
+		return FormatAuto, fmt.Errorf("unknown archive format: %s", s)
+	}
+}
+
+// DetectFormat sniffs an archive's magic bytes and reports its format.
+// Falls back to FormatTar if neither the cpio newc magic nor the tar ustar
+// magic is found, since old-style/GNU tar archives don't always carry the
+// ustar magic on every record.
+func DetectFormat(data []byte) Format {
+	if len(data) >= 6 && string(data[:6]) == "070701" {
+		return FormatCPIO
+	}
+	return FormatTar
+}
+
+// Entry is a single file, directory, symlink, hard link or device node in an
+// archive, expressed through the fields tar.Header already has, together
+// with its body. Using tar.Header as the common representation means both
+// readers/writers only need to convert typeflag and a handful of fields.
+type Entry struct {
+	Header *tar.Header
+	Body   []byte
+}
+
+// Reader reads entries out of an archive, regardless of its underlying format.
+// Next returns io.EOF once there are no more entries.
+type Reader interface {
+	Next() (*Entry, error)
+}
+
+// Writer writes entries into an archive, regardless of its underlying format.
+type Writer interface {
+	WriteEntry(e *Entry) error
+	Close() error
+}
+
+// NewReader returns a Reader for the given format.
+func NewReader(r io.Reader, format Format) Reader {
+	if format == FormatCPIO {
+		return &cpioReader{cr: cpio.NewReader(r)}
+	}
+	return &tarReader{tr: tar.NewReader(r)}
+}
+
+// NewWriter returns a Writer for the given format.
+func NewWriter(w io.Writer, format Format) Writer {
+	if format == FormatCPIO {
+		return &cpioWriter{cw: cpio.NewWriter(w)}
+	}
+	return &tarWriter{tw: tar.NewWriter(w)}
+}
+
+type tarReader struct{ tr *tar.Reader }
+
+func (t *tarReader) Next() (*Entry, error) {
+	hdr, err := t.tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, t.tr); err != nil {
+		return nil, err
+	}
+	return &Entry{Header: hdr, Body: buf.Bytes()}, nil
+}
+
+type tarWriter struct{ tw *tar.Writer }
+
+func (t *tarWriter) WriteEntry(e *Entry) error {
+	hdr := *e.Header
+	hdr.Size = int64(len(e.Body))
+	if hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeDir {
+		hdr.Size = 0
+	}
+	if err := t.tw.WriteHeader(&hdr); err != nil {
+		return err
+	}
+	if hdr.Size == 0 {
+		return nil
+	}
+	_, err := t.tw.Write(e.Body)
+	return err
+}
+
+func (t *tarWriter) Close() error { return t.tw.Close() }
+
+type cpioReader struct{ cr *cpio.Reader }
+
+func (c *cpioReader) Next() (*Entry, error) {
+	hdr, err := c.cr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Name == "TRAILER!!!" {
+		return nil, io.EOF
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, c.cr); err != nil {
+		return nil, err
+	}
+
+	tarHdr := &tar.Header{
+		Name:     hdr.Name,
+		Typeflag: cpioTypeToTarTypeflag(hdr.Type),
+		Mode:     hdr.Mode,
+		Uid:      hdr.Uid,
+		Gid:      hdr.Gid,
+		ModTime:  time.Unix(hdr.Mtime, 0),
+		Devmajor: hdr.Devmajor,
+		Devminor: hdr.Devminor,
+	}
+	if tarHdr.Typeflag == tar.TypeSymlink {
+		tarHdr.Linkname = buf.String()
+		return &Entry{Header: tarHdr}, nil
+	}
+	return &Entry{Header: tarHdr, Body: buf.Bytes()}, nil
+}
+
+type cpioWriter struct{ cw *cpio.Writer }
+
+func (c *cpioWriter) WriteEntry(e *Entry) error {
+	body := e.Body
+	if e.Header.Typeflag == tar.TypeSymlink || e.Header.Typeflag == tar.TypeLink {
+		body = []byte(e.Header.Linkname)
+	}
+
+	hdr := &cpio.Header{
+		Name:     e.Header.Name,
+		Mode:     e.Header.Mode,
+		Uid:      e.Header.Uid,
+		Gid:      e.Header.Gid,
+		Mtime:    e.Header.ModTime.Unix(),
+		Size:     int64(len(body)),
+		Devmajor: e.Header.Devmajor,
+		Devminor: e.Header.Devminor,
+		Type:     tarTypeflagToCPIO(e.Header.Typeflag),
+	}
+	if err := c.cw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := c.cw.Write(body)
+	return err
+}
+
+func (c *cpioWriter) Close() error { return c.cw.Close() }
+
+// tarTypeflagToCPIO maps a tar typeflag to the closest cpio type. Hard links
+// have no equivalent in the newc format, so (as elsewhere in metatar) they
+// are stored as symlinks pointing at Linkname, the same lossy-but-lossless
+// representation used for --apply/--generate's cpio path.
+func tarTypeflagToCPIO(tf byte) int64 {
+	switch tf {
+	case tar.TypeReg, tar.TypeRegA:
+		return cpio.TYPE_REG
+	case tar.TypeLink, tar.TypeSymlink:
+		return cpio.TYPE_SYMLINK
+	case tar.TypeChar:
+		return cpio.TYPE_CHAR
+	case tar.TypeBlock:
+		return cpio.TYPE_BLK
+	case tar.TypeDir:
+		return cpio.TYPE_DIR
+	case tar.TypeFifo:
+		return cpio.TYPE_FIFO
+	default:
+		return cpio.TYPE_REG
+	}
+}
+
+// cpioTypeToTarTypeflag maps a cpio type to the closest tar typeflag.
+func cpioTypeToTarTypeflag(t int64) byte {
+	switch t {
+	case cpio.TYPE_SOCK, cpio.TYPE_SYMLINK:
+		return tar.TypeSymlink
+	case cpio.TYPE_REG:
+		return tar.TypeReg
+	case cpio.TYPE_BLK:
+		return tar.TypeBlock
+	case cpio.TYPE_DIR:
+		return tar.TypeDir
+	case cpio.TYPE_CHAR:
+		return tar.TypeChar
+	case cpio.TYPE_FIFO:
+		return tar.TypeFifo
+	default:
+		return tar.TypeReg
+	}
+}
+
+// KeepFunc reports whether an entry with the given name should be kept
+// (copied to the destination archive) during a Convert.
+type KeepFunc func(name string) bool
+
+// Convert reads every entry out of data (in srcFormat, or auto-detected if
+// srcFormat is FormatAuto), and writes the entries for which keep returns
+// true to dst in dstFormat. A nil keep keeps everything.
+func Convert(data []byte, srcFormat Format, dst io.Writer, dstFormat Format, keep KeepFunc) error {
+	if srcFormat == FormatAuto {
+		srcFormat = DetectFormat(data)
+	}
+
+	r := NewReader(bytes.NewReader(data), srcFormat)
+	w := NewWriter(dst, dstFormat)
+
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if keep != nil && !keep(e.Header.Name) {
+			continue
+		}
+		if err := w.WriteEntry(e); err != nil {
+			return err
+		}
+	}
+
+	return w.Close()
+}
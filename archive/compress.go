@@ -0,0 +1,40 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"io"
+)
+
+var xzMagic = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+
+// Decompress peeks at r's leading bytes to auto-detect gzip, bzip2, xz or
+// zstd compression (the same magic-number sniff Docker's pkg/archive and
+// containerd's archive/compression use) and returns r wrapped in the
+// matching decompressor. Uncompressed input is returned as-is, with the
+// peeked bytes put back, so the caller pays no cost beyond a small buffered
+// read. xz and zstd are detected but rejected rather than silently passed
+// through compressed, since metatar has neither dependency vendored.
+func Decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(6)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		return gzip.NewReader(br)
+	case len(magic) >= 3 && magic[0] == 'B' && magic[1] == 'Z' && magic[2] == 'h':
+		return bzip2.NewReader(br), nil
+	case len(magic) >= 4 && magic[0] == 0x28 && magic[1] == 0xb5 && magic[2] == 0x2f && magic[3] == 0xfd:
+		return nil, errors.New("archive: zstd-compressed input is not supported (no zstd dependency vendored)")
+	case len(magic) >= 6 && bytes.Equal(magic[:6], xzMagic):
+		return nil, errors.New("archive: xz-compressed input is not supported (no xz dependency vendored)")
+	default:
+		return br, nil
+	}
+}
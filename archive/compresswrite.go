@@ -0,0 +1,51 @@
+package archive
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// nopWriteCloser adapts an io.Writer that has no Close of its own (such as a
+// bytes.Buffer, or a format that passes through uncompressed) to
+// io.WriteCloser, so CompressWriter always returns a closable value.
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// CompressWriter wraps w with an encoder for format ("gzip", "zstd", "xz" or
+// "none"/""), the write-side counterpart to Decompress. zstd and xz are
+// recognized but rejected, since metatar has neither dependency vendored;
+// ask for "gzip" or "none" instead. The caller must Close the returned
+// writer to flush the encoder (and, for "none", is a harmless no-op).
+func CompressWriter(w io.Writer, format string) (io.WriteCloser, error) {
+	switch format {
+	case "", "none":
+		return nopWriteCloser{w}, nil
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return nil, fmt.Errorf("archive: zstd output is not supported (no zstd dependency vendored)")
+	case "xz":
+		return nil, fmt.Errorf("archive: xz output is not supported (no xz dependency vendored)")
+	default:
+		return nil, fmt.Errorf("archive: unknown compression format %q", format)
+	}
+}
+
+// DetectCompressionFromName returns the compression format implied by
+// filename's suffix (".gz" -> "gzip", ".zst" -> "zstd", ".xz" -> "xz"), or
+// "" if filename doesn't end in a recognized compressed-archive suffix.
+func DetectCompressionFromName(filename string) string {
+	switch {
+	case strings.HasSuffix(filename, ".gz") || strings.HasSuffix(filename, ".tgz"):
+		return "gzip"
+	case strings.HasSuffix(filename, ".zst"):
+		return "zstd"
+	case strings.HasSuffix(filename, ".xz"):
+		return "xz"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,73 @@
+package archive
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestCompressWriterGzipRoundTrips(t *testing.T) {
+	var buf bytes.Buffer
+	cw, err := CompressWriter(&buf, "gzip")
+	if err != nil {
+		t.Fatalf("CompressWriter: %v", err)
+	}
+	if _, err := cw.Write([]byte("hello, metatar\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Decompress(&buf)
+	if err != nil {
+		t.Fatalf("Decompress: %v", err)
+	}
+	got := make([]byte, len("hello, metatar\n"))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello, metatar\n" {
+		t.Errorf("got %q, want %q", got, "hello, metatar\n")
+	}
+}
+
+func TestCompressWriterNonePassesThrough(t *testing.T) {
+	var buf bytes.Buffer
+	cw, err := CompressWriter(&buf, "none")
+	if err != nil {
+		t.Fatalf("CompressWriter: %v", err)
+	}
+	if _, err := cw.Write([]byte("plain data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "plain data" {
+		t.Errorf("got %q, want %q", buf.String(), "plain data")
+	}
+}
+
+func TestCompressWriterRejectsZstdAndXz(t *testing.T) {
+	for _, format := range []string{"zstd", "xz"} {
+		if _, err := CompressWriter(&bytes.Buffer{}, format); err == nil {
+			t.Errorf("expected an error for format %q", format)
+		}
+	}
+}
+
+func TestDetectCompressionFromName(t *testing.T) {
+	cases := map[string]string{
+		"rootfs.tar.gz":   "gzip",
+		"initrd.tgz":      "gzip",
+		"initrd.cpio.zst": "zstd",
+		"rootfs.tar.xz":   "xz",
+		"rootfs.tar":      "",
+	}
+	for name, want := range cases {
+		if got := DetectCompressionFromName(name); got != want {
+			t.Errorf("DetectCompressionFromName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package archive
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/surma/gocpio"
+)
+
+// ReproducibleCPIOWriter writes a cpio (newc format) archive the same way
+// github.com/surma/gocpio's Writer does, except its inode numbers start
+// from a caller-chosen value and increment by one per entry, instead of
+// gocpio's hardcoded start at 721. gocpio's Header has no Ino field to
+// override per call, so --reproducible's "stable inode counter starting
+// from 1" needs this separate writer rather than a field on cpio.Header.
+type ReproducibleCPIOWriter struct {
+	w              io.Writer
+	inode          int64
+	length         int64
+	remainingBytes int
+}
+
+// NewReproducibleCPIOWriter returns a ReproducibleCPIOWriter over w whose
+// first entry is numbered startInode.
+func NewReproducibleCPIOWriter(w io.Writer, startInode int64) *ReproducibleCPIOWriter {
+	return &ReproducibleCPIOWriter{w: w, inode: startInode}
+}
+
+func cpioAssembleModeType(mode, typev int64) int64 {
+	return mode&0xFFF | ((typev & 0xF) << 12)
+}
+
+// WriteHeader begins a new entry, flushing any unwritten padding left over
+// from the previous one. Every call to Write afterwards appends to that
+// entry, writing at most hdr.Size bytes in total.
+func (w *ReproducibleCPIOWriter) WriteHeader(hdr *cpio.Header) error {
+	if err := w.zeros(int64(w.remainingBytes)); err != nil {
+		return err
+	}
+	if err := w.pad(4); err != nil {
+		return err
+	}
+
+	bname := []byte(hdr.Name)
+	nlinks := int64(1)
+	if hdr.Type == cpio.TYPE_DIR {
+		nlinks = 2
+	}
+	shdr := fmt.Sprintf("%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		"070701",
+		w.inode,
+		cpioAssembleModeType(hdr.Mode, hdr.Type),
+		hdr.Uid,
+		hdr.Gid,
+		nlinks,
+		hdr.Mtime,
+		hdr.Size,
+		3, // major
+		1, // minor
+		hdr.Devmajor,
+		hdr.Devminor,
+		len(bname)+1, // +1 for terminating zero
+		0)            // check
+	if _, err := w.countedWrite([]byte(shdr)); err != nil {
+		return err
+	}
+	if _, err := w.countedWrite(bname); err != nil {
+		return err
+	}
+	if _, err := w.countedWrite([]byte{0}); err != nil {
+		return err
+	}
+
+	w.inode++
+	w.remainingBytes = int(hdr.Size)
+	return w.pad(4)
+}
+
+func (w *ReproducibleCPIOWriter) zeros(num int64) error {
+	for ; num > 0; num-- {
+		if _, err := w.countedWrite([]byte{0}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pad brings the length of the archive written so far to a multiple of mod.
+func (w *ReproducibleCPIOWriter) pad(mod int64) error {
+	return w.zeros((mod - (w.length % mod)) % mod)
+}
+
+func (w *ReproducibleCPIOWriter) Write(b []byte) (int, error) {
+	if len(b) > w.remainingBytes {
+		b = b[:w.remainingBytes]
+	}
+	n, err := w.countedWrite(b)
+	w.remainingBytes -= n
+	return n, err
+}
+
+func (w *ReproducibleCPIOWriter) countedWrite(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.length += int64(n)
+	return n, err
+}
+
+// Close writes the "TRAILER!!!" entry gocpio uses to mark the end of the
+// archive and pads it to a 512-byte boundary. It does not close the
+// underlying writer.
+func (w *ReproducibleCPIOWriter) Close() error {
+	if err := w.WriteHeader(&cpio.Header{Name: "TRAILER!!!"}); err != nil {
+		return err
+	}
+	return w.pad(512)
+}
@@ -0,0 +1,92 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+)
+
+// StreamEntry is like Entry, but Body is a lazily-read io.Reader instead of
+// a fully-buffered []byte, so a caller can stream large file contents
+// instead of loading the whole archive into memory.
+type StreamEntry struct {
+	Header *tar.Header
+	Body   io.Reader
+}
+
+// spillThreshold is the body size above which StreamReader spills an
+// entry's content to a temp file instead of buffering it in memory.
+const spillThreshold = 32 << 20 // 32MiB
+
+// StreamReader reads entries out of a tar archive one at a time without
+// requiring the whole archive to be read into memory first. It is the
+// streaming counterpart to NewReader's in-memory Entry/[]byte API, meant for
+// archives too large to buffer whole, such as multi-GB container layers.
+// This is currently wired into ListTar and WriteMetadata. ListCPIO streams
+// cpio archives the same way but reads directly off a decompressed
+// io.Reader via surma/gocpio, since StreamReader is tar-specific. Routing
+// ApplyMetadataToTar through it as a two-pass (index, then seek+copy)
+// writer is follow-up work.
+type StreamReader struct {
+	tr *tar.Reader
+}
+
+// NewStreamReader returns a StreamReader over r. r should already be
+// decompressed (see Decompress) if the underlying archive is compressed.
+func NewStreamReader(r io.Reader) *StreamReader {
+	return &StreamReader{tr: tar.NewReader(r)}
+}
+
+// Next returns the next entry's header and a Body reader. Body must be
+// fully read (or discarded) before the next call to Next, since both read
+// from the same underlying tar stream. A body larger than spillThreshold is
+// copied to an already-unlinked temp file instead of memory, so StreamReader
+// never buffers more than spillThreshold bytes of any one entry at once;
+// the temp file's disk space is freed as soon as Body is read to EOF or
+// closed.
+func (s *StreamReader) Next() (*StreamEntry, error) {
+	hdr, err := s.tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Size <= spillThreshold {
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, s.tr, hdr.Size); err != nil && err != io.EOF {
+			return nil, err
+		}
+		return &StreamEntry{Header: hdr, Body: &buf}, nil
+	}
+
+	f, err := os.CreateTemp("", "metatar-spill-*")
+	if err != nil {
+		return nil, err
+	}
+	// Unlink immediately: the open file descriptor keeps the data alive
+	// until Read hits EOF or the caller Closes it, but no directory entry
+	// is left behind if metatar exits early.
+	if err := os.Remove(f.Name()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := io.CopyN(f, s.tr, hdr.Size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &StreamEntry{Header: hdr, Body: &spillFile{File: f}}, nil
+}
+
+// spillFile is a StreamEntry.Body backed by an already-unlinked temp file.
+type spillFile struct{ *os.File }
+
+func (s *spillFile) Read(p []byte) (int, error) {
+	n, err := s.File.Read(p)
+	if err == io.EOF {
+		s.File.Close()
+	}
+	return n, err
+}
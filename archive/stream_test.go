@@ -0,0 +1,120 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+)
+
+func TestStreamReaderReadsEntries(t *testing.T) {
+	data := buildTar(t)
+
+	sr := NewStreamReader(bytes.NewReader(data))
+	var names []string
+	for {
+		e, err := sr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		names = append(names, e.Header.Name)
+		if e.Header.Name == "dir/file.txt" {
+			body, err := io.ReadAll(e.Body)
+			if err != nil {
+				t.Fatalf("reading body: %v", err)
+			}
+			if string(body) != "hello, metatar\n" {
+				t.Errorf("body = %q, want %q", body, "hello, metatar\n")
+			}
+		}
+	}
+	if len(names) != 6 {
+		t.Errorf("got %d entries, want 6", len(names))
+	}
+}
+
+func TestStreamReaderSpillsLargeBodies(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), spillThreshold+1)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "big.bin", Mode: 0644, Size: int64(len(large))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(large); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sr := NewStreamReader(&buf)
+	e, err := sr.Next()
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if _, ok := e.Body.(*spillFile); !ok {
+		t.Fatalf("a body over spillThreshold should be backed by a spillFile, got %T", e.Body)
+	}
+	got, err := io.ReadAll(e.Body)
+	if err != nil {
+		t.Fatalf("reading spilled body: %v", err)
+	}
+	if len(got) != len(large) {
+		t.Errorf("got %d bytes, want %d", len(got), len(large))
+	}
+}
+
+func TestDecompressGzip(t *testing.T) {
+	var gzBuf bytes.Buffer
+	gw := gzip.NewWriter(&gzBuf)
+	if _, err := gw.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Decompress(&gzBuf)
+	if err != nil {
+		t.Fatalf("Decompress: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello\n" {
+		t.Errorf("got %q, want %q", got, "hello\n")
+	}
+}
+
+func TestDecompressPassesThroughUncompressed(t *testing.T) {
+	r, err := Decompress(bytes.NewReader([]byte("plain data")))
+	if err != nil {
+		t.Fatalf("Decompress: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "plain data" {
+		t.Errorf("got %q, want %q", got, "plain data")
+	}
+}
+
+func TestDecompressRejectsZstd(t *testing.T) {
+	zstdMagic := []byte{0x28, 0xb5, 0x2f, 0xfd, 0, 0, 0, 0}
+	if _, err := Decompress(bytes.NewReader(zstdMagic)); err == nil {
+		t.Error("expected an error for zstd-compressed input")
+	}
+}
+
+func TestDecompressRejectsXz(t *testing.T) {
+	if _, err := Decompress(bytes.NewReader(xzMagic)); err == nil {
+		t.Error("expected an error for xz-compressed input")
+	}
+}
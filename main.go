@@ -3,22 +3,35 @@ package main
 import (
 	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/docopt/docopt-go"
 	"github.com/fatih/color"
 	"github.com/gobwas/glob"
 	"github.com/surma/gocpio"
+	"github.com/xyproto/metatar/archive"
+	"github.com/xyproto/metatar/metafs"
+	"github.com/xyproto/metatar/tarsplit"
 	"github.com/xyproto/yaml"
 )
 
@@ -32,13 +45,17 @@ const (
 	usage          = `metatar
 
 Usage:
-  metatar -s | --save [(-f | --force)] [(-v | --verbose)] [(-d | --data)] [(-e | --expand)] [(-r | --root)] [(-n | --nouser)] <tarfile> <yamlfile>
-  metatar -a | --apply [(-f | --force)] [(-v | --verbose)] [(-d | --data)] [(-c | --cpio)] [(-o | --noskip)] <tarfile> <yamlfile> <newfile>
-  metatar -g | --generate [(-f | --force)] [(-v | --verbose)] <yamlfile> <newfile>
+  metatar -s | --save [(-f | --force)] [(-v | --verbose)] [(-d | --data)] [(-e | --expand)] [(-r | --root)] [(-n | --nouser)] [--rawstream] [--extract-bodies=<dir>] [--input-url=<url>] [--output-url=<url>] <tarfile> <yamlfile>
+  metatar -a | --apply [(-f | --force)] [(-v | --verbose)] [(-d | --data)] [(-c | --cpio)] [(-o | --noskip)] [--rules=<rulesfile>] [--rawstream] [--whiteout=<style>] [--compress=<fmt>] [--reproducible] [--source-date-epoch=<epoch>] [--numeric-owner] [--input-url=<url>] [--output-url=<url>] <tarfile> <yamlfile> <newfile>
+  metatar -g | --generate [(-f | --force)] [(-v | --verbose)] [--rules=<rulesfile>] [--whiteout=<style>] [--compress=<fmt>] [--reproducible] [--source-date-epoch=<epoch>] [--numeric-owner] [--input-url=<url>] [--output-url=<url>] <yamlfile> <newfile>
   metatar -l | --list <tarfile>
   metatar -p | --listcpio <cpiofile>
-  metatar -y | --yaml [(-v | --verbose)] [(-d | --data)] [(-e | --expand)] [(-r | --root)] [(-n | --nouser)] <tarfile>
-  metatar -m | --merge [(-f | --force)] [(-v | --verbose)] <yamlfile1> <yamlfile2> <newfile>
+  metatar -y | --yaml [(-v | --verbose)] [(-d | --data)] [(-e | --expand)] [(-r | --root)] [(-n | --nouser)] [--input-url=<url>] <tarfile>
+  metatar -m | --merge [(-f | --force)] [(-v | --verbose)] [--input-url=<url>] [--output-url=<url>] <yamlfile1> <yamlfile2> <newfile>
+  metatar -x | --convert --format=<fmt> [(-f | --force)] [(-v | --verbose)] [--skip=<pattern>]... [--include=<pattern>]... [--exclude=<pattern>]... <tarfile> <newfile>
+  metatar --verify [(-v | --verbose)] <tarfile> <yamlfile>
+  metatar --oci [(-f | --force)] [(-v | --verbose)] [--rules=<rulesfile>] [--whiteout=<style>] <outputdir> <layeryaml>...
+  metatar --diff [(-f | --force)] [(-v | --verbose)] <oldtarfile> <newtarfile> <patchyaml>
   metatar -h | --help
   metatar -V | --version
 
@@ -46,7 +63,9 @@ Options:
   -h --help        Show this screen.
   -V --version     Show version.
   -s --save        Save the tar metadata to a YAML file.
-  -a --apply       Apply YAML metadata to tar file.
+  -a --apply       Apply YAML metadata to tar file. Any entry with a Digest
+                   is checked against the body being written; a mismatch
+                   fails the run, or just warns under --verbose.
   -l --list        List the contents of a tar file.
   -p --listcpio    List the contents of a cpio/newc file.
   -y --yaml        Output YAML metadata.
@@ -60,6 +79,69 @@ Options:
   -c --cpio        Output a cpio/newc file instead of tar.
   -n --nouser      Don't output User, Group, UID and GID fields.
   -o --noskip      Don't skip empty regular files.
+  -x --convert     Convert an archive between tar and cpio/newc format.
+  --verify         Check every entry with a Digest or TreeDigest in the YAML
+                   metadata (and RootDigest, if set) against the contents of
+                   a tar file.
+  --whiteout=<style>  How to write Whiteout/OpaqueDir entries on apply:
+                   "aufs" (the default) for ".wh.<name>" marker files, or
+                   "overlay" for OverlayFS-style character devices and a
+                   "trusted.overlay.opaque=y" xattr [default: aufs].
+  --compress=<fmt>  Compress <newfile> with "gzip" on apply/generate, or
+                   "none" to disable. On the input side, gzip and bzip2 are
+                   always auto-detected and transparently decompressed
+                   regardless of this flag; zstd and xz are auto-detected
+                   too, but only to fail with a clear error, since metatar
+                   has neither dependency vendored. Defaults to
+                   auto-detecting from the <newfile> suffix (.gz/.zst/.xz).
+  --reproducible  Write <newfile> canonically on apply/generate: entries in
+                   sorted filename order, a fixed mtime for anything that
+                   doesn't declare its own, and (for --cpio) inode numbers
+                   from a stable counter starting at 1, so two runs over the
+                   same inputs produce byte-identical output.
+  --source-date-epoch=<epoch>  The mtime (seconds since epoch) --reproducible
+                   stamps entries with. Falls back to $SOURCE_DATE_EPOCH, then
+                   to 0 (the Unix epoch), per
+                   https://reproducible-builds.org/specs/source-date-epoch/.
+  --numeric-owner  Clear symbolic owner/group names from tar entries on
+                   apply/generate, the --numeric-owner behavior from GNU tar.
+  --format=<fmt>   Input format for --convert: tar, cpio or auto [default: auto].
+  --skip=<pattern>  Glob pattern of entries to skip when converting (repeatable).
+  --rules=<rulesfile>  A YAML file of include/exclude/rename/chmod/chown/... rules
+                   to apply to each entry's metadata, keyed by glob pattern.
+                   Falls back to a discovered ".metatar.yaml" when not given.
+  --include=<pattern>  Entries to keep during --convert, overriding a
+                   broader exclusion rule (repeatable; relative order of
+                   include/exclude flags matters, gitignore-style).
+  --exclude=<pattern>  Entries to leave out during --convert (repeatable).
+  --oci            Build an OCI image layout in <outputdir>: one gzipped
+                   tar layer blob per <layeryaml>, plus a manifest.json,
+                   config.json and index.json, honoring the same rules
+                   file and whiteout style as apply and generate.
+  --diff           Compare <oldtarfile> against <newtarfile> and write
+                   <patchyaml>: a Contents entry with Body: for every file
+                   added or changed in <newtarfile>, a Whiteout: true entry
+                   for every path removed, and an OpaqueDir: true entry for
+                   a directory whose entire old contents were replaced.
+                   Feed the result to --generate to turn it into a minimal
+                   OCI layer tarball containing just the diff.
+  --rawstream      On save, also write a "<yamlfile>.rawstream" sidecar
+                   capturing the tar's exact byte layout; on apply (tar
+                   output only), use that sidecar to reassemble <newfile>
+                   byte-for-byte instead of rebuilding headers from the YAML.
+                   Mutually exclusive with Skip/Rename/Strip rules, since
+                   those change the tar's shape.
+  --extract-bodies=<dir>  With --save, write each file's body into <dir>'s
+                   content-addressed blob store instead of inlining it as
+                   base64, recording a "BodyRef: sha256:…" in the YAML
+                   instead of "Body:". --apply/--generate resolve BodyRef
+                   (also "file:<path>" and "http(s)://…") lazily.
+  --input-url=<url>  Read the input file through a metafs backend chosen by
+                   URL scheme: "file://<path>" for the real filesystem
+                   (the default), or "basepath://<dir>!<path>" to confine
+                   reads under <dir>. Overrides <tarfile>/<yamlfile>.
+  --output-url=<url>  Write the output file through a metafs backend, same
+                   scheme syntax as --input-url. Overrides <yamlfile>/<newfile>.
 
 Possible values for the 'type:' field in the YAML file:
   "regular file"		"regular file (A)"			"hard link"
@@ -74,6 +156,15 @@ Possible commands for files in the YAML file:
   "Rename: newfilename.txt", for renaming a file.
   "StripEmptyLines: true", for stripping newlines.
   "StripComments: true", for stripping lines beginning with "#" (but not #!).
+  "Transforms: [{name: ..., args: {...}}, ...]", for running a file's body
+  through an ordered pipeline of registered Transformer steps (see
+  RegisterTransform); built in: strip-empty-lines, strip-comments, gzip,
+  gunzip, sed, template, chmod, rebase-path, patch.
+
+Possible top-level fields in the YAML file, used by the --oci command:
+  "History: [{CreatedBy: ..., Comment: ...}, ...]", one entry per history
+  record this layer should contribute to the generated config.json. A
+  layer with no History gets a single generated entry instead.
 `
 )
 
@@ -86,54 +177,70 @@ type Xattr struct {
 // MetaFileRegular represents all metadata for a file in a tar archive.
 // "omitempty" is used to omit several fields that are normally empty.
 type MetaFileRegular struct {
-	Filename        string     `yaml:"Filename"`
-	Skip            bool       `yaml:"Skip,omitempty"`   // For skipping files
-	Rename          string     `yaml:"Rename,omitempty"` // For renaming files + altering metadata
-	Linkname        string     `yaml:"Linkname,omitempty"`
-	StripEmptyLines bool       `yaml:"StripEmptyLines,omitempty"` // For stripping empty lines
-	StripComments   bool       `yaml:"StripComments,omitempty"`   // For stripping comments
-	Type            string     `yaml:"Type"`
-	Mode            yaml.Octal `yaml:"Mode"`
-	UID             int        `yaml:"UID"`
-	GID             int        `yaml:"GID"`
-	Username        string     `yaml:"Username"`
-	Groupname       string     `yaml:"Groupname"`
-	Devmajor        int64      `yaml:"Devmajor,omitempty"`
-	Devminor        int64      `yaml:"Devminor,omitempty"`
-	BodySize        int        `yaml:"Size,omitempty"` // size of decoded file body
-	Body            string     `yaml:"Body,omitempty"` // base64 encoded file body
-	Xattrs          []Xattr    `yaml:"Xattrs,omitempty"`
+	Filename        string          `yaml:"Filename"`
+	Skip            bool            `yaml:"Skip,omitempty"`   // For skipping files
+	Rename          string          `yaml:"Rename,omitempty"` // For renaming files + altering metadata
+	Linkname        string          `yaml:"Linkname,omitempty"`
+	StripEmptyLines bool            `yaml:"StripEmptyLines,omitempty"` // For stripping empty lines
+	StripComments   bool            `yaml:"StripComments,omitempty"`   // For stripping comments
+	Transforms      []TransformSpec `yaml:"Transforms,omitempty"`      // Body transform pipeline, see RegisterTransform
+	Type            string          `yaml:"Type"`
+	Mode            yaml.Octal      `yaml:"Mode"`
+	UID             int             `yaml:"UID"`
+	GID             int             `yaml:"GID"`
+	Username        string          `yaml:"Username"`
+	Groupname       string          `yaml:"Groupname"`
+	Devmajor        int64           `yaml:"Devmajor,omitempty"`
+	Devminor        int64           `yaml:"Devminor,omitempty"`
+	Mtime           int64           `yaml:"Mtime,omitempty"`     // modification time, seconds since epoch
+	BodySize        int             `yaml:"Size,omitempty"`      // size of decoded file body
+	Body            string          `yaml:"Body,omitempty"`      // base64 encoded file body
+	BodyRef         string          `yaml:"BodyRef,omitempty"`   // body fetched lazily, see resolveBodyRef
+	Digest          string          `yaml:"Digest,omitempty"`     // "sha256:<hex>" content digest, for regular files
+	TreeDigest      string          `yaml:"TreeDigest,omitempty"` // "sha256:<hex>" recursive digest over a directory's children, see computeTreeDigests
+	Whiteout        bool            `yaml:"Whiteout,omitempty"`   // OCI layer deletion marker for Filename
+	OpaqueDir       bool            `yaml:"OpaqueDir,omitempty"`  // OCI layer marker: Filename's directory contents replace the lower layer's
+	Xattrs          []Xattr         `yaml:"Xattrs,omitempty"`
 }
 
 // MetaFileExpanded represents all metadata for a file in a tar archive.
 // Like MetaFile, but without the "omitempty" tag.
 type MetaFileExpanded struct {
-	Filename        string     `yaml:"Filename"`
-	Skip            bool       `yaml:"Skip"`   // For skipping files
-	Rename          string     `yaml:"Rename"` // For renaming files + altering metadata
-	Linkname        string     `yaml:"Linkname"`
-	StripEmptyLines bool       `yaml:"StripEmptyLines"` // For stripping empty lines
-	StripComments   bool       `yaml:"StripComments"`   // For stripping comments
-	Type            string     `yaml:"Type"`
-	Mode            yaml.Octal `yaml:"Mode"`
-	UID             int        `yaml:"UID"`
-	GID             int        `yaml:"GID"`
-	Username        string     `yaml:"Username"`
-	Groupname       string     `yaml:"Groupname"`
-	Devmajor        int64      `yaml:"Devmajor"`
-	Devminor        int64      `yaml:"Devminor"`
-	BodySize        int        `yaml:"Size"` // size of decoded file body
-	Body            string     `yaml:"Body"` // base64 encoded file body
-	Xattrs          []Xattr    `yaml:"Xattrs,flow"`
+	Filename        string          `yaml:"Filename"`
+	Skip            bool            `yaml:"Skip"`   // For skipping files
+	Rename          string          `yaml:"Rename"` // For renaming files + altering metadata
+	Linkname        string          `yaml:"Linkname"`
+	StripEmptyLines bool            `yaml:"StripEmptyLines"` // For stripping empty lines
+	StripComments   bool            `yaml:"StripComments"`   // For stripping comments
+	Transforms      []TransformSpec `yaml:"Transforms"`      // Body transform pipeline, see RegisterTransform
+	Type            string          `yaml:"Type"`
+	Mode            yaml.Octal      `yaml:"Mode"`
+	UID             int             `yaml:"UID"`
+	GID             int             `yaml:"GID"`
+	Username        string          `yaml:"Username"`
+	Groupname       string          `yaml:"Groupname"`
+	Devmajor        int64           `yaml:"Devmajor"`
+	Devminor        int64           `yaml:"Devminor"`
+	Mtime           int64           `yaml:"Mtime"`     // modification time, seconds since epoch
+	BodySize        int             `yaml:"Size"`      // size of decoded file body
+	Body            string          `yaml:"Body"`      // base64 encoded file body
+	BodyRef         string          `yaml:"BodyRef"`   // body fetched lazily, see resolveBodyRef
+	Digest          string          `yaml:"Digest"`     // "sha256:<hex>" content digest, for regular files
+	TreeDigest      string          `yaml:"TreeDigest"` // "sha256:<hex>" recursive digest over a directory's children, see computeTreeDigests
+	Whiteout        bool            `yaml:"Whiteout"`   // OCI layer deletion marker for Filename
+	OpaqueDir       bool            `yaml:"OpaqueDir"`  // OCI layer marker: Filename's directory contents replace the lower layer's
+	Xattrs          []Xattr         `yaml:"Xattrs,flow"`
 }
 
 // MetaArchiveRegular represents all the metadata in a tar file.
 // Everything but the actual file contents.
 // Same as MetaArchiveExpanded, but with different YAML tags.
 type MetaArchiveRegular struct {
-	Version  float64           `yaml:"MetaTAR Version"`
-	Contents []MetaFileRegular `yaml:"Contents"`
-	SkipList []string          `yaml:"SkipList,omitempty"`
+	Version    float64           `yaml:"MetaTAR Version"`
+	Contents   []MetaFileRegular `yaml:"Contents"`
+	SkipList   []string          `yaml:"SkipList,omitempty"`
+	RootDigest string            `yaml:"RootDigest,omitempty"` // Merkle-style digest over all Contents, see Checksum
+	History    []OCIHistory      `yaml:"History,omitempty"`    // --oci: this layer's config.json history entries
 }
 
 // ShouldSkipFunc is a function that determines if a given filename should be skipped or not
@@ -143,9 +250,317 @@ type ShouldSkipFunc func(string) bool
 // Everything but the actual file contents.
 // Same as MetaArchiveRegular, but with different YAML tags.
 type MetaArchiveExpanded struct {
-	Version  float64            `yaml:"MetaTAR Version"`
-	Contents []MetaFileExpanded `yaml:"Contents"`
-	SkipList []string           `yaml:"SkipList,omitempty"`
+	Version    float64            `yaml:"MetaTAR Version"`
+	Contents   []MetaFileExpanded `yaml:"Contents"`
+	SkipList   []string           `yaml:"SkipList,omitempty"`
+	RootDigest string             `yaml:"RootDigest"` // Merkle-style digest over all Contents, see Checksum
+	History    []OCIHistory       `yaml:"History"`    // --oci: this layer's config.json history entries
+}
+
+// OCIHistory is one entry of a --oci layer's optional "History:" YAML field,
+// carried through verbatim into the generated config.json's history array.
+type OCIHistory struct {
+	CreatedBy string `yaml:"CreatedBy,omitempty"`
+	Comment   string `yaml:"Comment,omitempty"`
+}
+
+// contentDigest returns the "sha256:<hex>" digest of body, in the same
+// format used by OCI/buildkit content digests.
+func contentDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// digestEntry is the subset of a MetaFileRegular/MetaFileExpanded entry that
+// feeds into its canonical digest: path, type, mode, uid, gid and content
+// digest (or, for a symlink, its link target).
+type digestEntry struct {
+	Path    string
+	Type    string
+	Mode    string
+	UID     int
+	GID     int
+	Content string
+}
+
+// digest returns the stable digest of the entry's canonical form. This is
+// the per-entry building block for computeRootDigest, modeled after
+// buildkit's contenthash package.
+func (e digestEntry) digest() string {
+	canonical := strings.Join([]string{
+		filepath.Clean(e.Path), e.Type, e.Mode, strconv.Itoa(e.UID), strconv.Itoa(e.GID), e.Content,
+	}, "\x00")
+	return contentDigest([]byte(canonical))
+}
+
+// computeRootDigestEntries returns a stable Merkle-style digest over
+// entries: their per-entry digests, sorted by cleaned path so that the
+// result doesn't depend on the order entries were stored in, concatenated
+// and hashed once more.
+func computeRootDigestEntries(entries []digestEntry) string {
+	sorted := make([]digestEntry, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool {
+		return filepath.Clean(sorted[i].Path) < filepath.Clean(sorted[j].Path)
+	})
+
+	var buf bytes.Buffer
+	for _, e := range sorted {
+		buf.WriteString(e.digest())
+		buf.WriteByte('\n')
+	}
+	return contentDigest(buf.Bytes())
+}
+
+// sortedByFilename returns a copy of contents sorted by cleaned Filename,
+// the canonical order --reproducible writes entries in so that two runs
+// over the same inputs produce byte-identical archives regardless of the
+// order they appear in the YAML or a map.
+func sortedByFilename(contents []MetaFileRegular) []MetaFileRegular {
+	sorted := make([]MetaFileRegular, len(contents))
+	copy(sorted, contents)
+	sort.Slice(sorted, func(i, j int) bool {
+		return filepath.Clean(sorted[i].Filename) < filepath.Clean(sorted[j].Filename)
+	})
+	return sorted
+}
+
+// computeRootDigest is computeRootDigestEntries for a MetaFileRegular slice.
+func computeRootDigest(contents []MetaFileRegular) string {
+	entries := make([]digestEntry, len(contents))
+	for i, mf := range contents {
+		content := mf.Digest
+		if content == "" {
+			content = mf.Linkname
+		}
+		entries[i] = digestEntry{mf.Filename, mf.Type, mf.Mode.String(), mf.UID, mf.GID, content}
+	}
+	return computeRootDigestEntries(entries)
+}
+
+// computeRootDigestExpanded is computeRootDigestEntries for a
+// MetaFileExpanded slice.
+func computeRootDigestExpanded(contents []MetaFileExpanded) string {
+	entries := make([]digestEntry, len(contents))
+	for i, mf := range contents {
+		content := mf.Digest
+		if content == "" {
+			content = mf.Linkname
+		}
+		entries[i] = digestEntry{mf.Filename, mf.Type, mf.Mode.String(), mf.UID, mf.GID, content}
+	}
+	return computeRootDigestEntries(entries)
+}
+
+// computeTreeDigests returns a copy of contents with TreeDigest filled in
+// for every directory entry: a recursive digest over the directory's direct
+// children, modeled after buildkit's contenthash package (one record per
+// directory for its own header, folded here into Digest/Mode/etc., and one
+// for its recursive content, stored as TreeDigest). Directories are
+// processed deepest-first so a parent's record can use its children's
+// already-computed TreeDigest.
+func computeTreeDigests(contents []MetaFileRegular) []MetaFileRegular {
+	out := make([]MetaFileRegular, len(contents))
+	copy(out, contents)
+
+	byParent := make(map[string][]*MetaFileRegular)
+	dirs := make(map[string]*MetaFileRegular)
+	for i := range out {
+		name := strings.TrimSuffix(out[i].Filename, "/")
+		byParent[filepath.Dir(name)] = append(byParent[filepath.Dir(name)], &out[i])
+		if out[i].Type == "directory" {
+			dirs[name] = &out[i]
+		}
+	}
+
+	names := make([]string, 0, len(dirs))
+	for name := range dirs {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return strings.Count(names[i], "/") > strings.Count(names[j], "/")
+	})
+	for _, name := range names {
+		dirs[name].TreeDigest = directoryContentDigest(byParent[name])
+	}
+	return out
+}
+
+// directoryContentDigest hashes a stable serialization of {name, mode, uid,
+// gid, xattrs, content-digest-or-linkname} for each of a directory's direct
+// children, sorted by name. A child directory contributes its own
+// TreeDigest as its content, so the digest folds in the whole subtree.
+func directoryContentDigest(children []*MetaFileRegular) string {
+	sorted := make([]*MetaFileRegular, len(children))
+	copy(sorted, children)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Filename < sorted[j].Filename })
+
+	var buf bytes.Buffer
+	for _, mf := range sorted {
+		content := mf.Digest
+		if mf.Type == "directory" {
+			content = mf.TreeDigest
+		} else if content == "" {
+			content = mf.Linkname
+		}
+		buf.WriteString(strings.Join([]string{
+			filepath.Clean(mf.Filename), mf.Mode.String(), strconv.Itoa(mf.UID), strconv.Itoa(mf.GID), canonicalXattrs(mf.Xattrs), content,
+		}, "\x00"))
+		buf.WriteByte('\n')
+	}
+	return contentDigest(buf.Bytes())
+}
+
+// canonicalXattrs returns a stable, sorted string form of xattrs for use in
+// a TreeDigest's canonical serialization.
+func canonicalXattrs(xattrs []Xattr) string {
+	sorted := make([]Xattr, len(xattrs))
+	copy(sorted, xattrs)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+	parts := make([]string, len(sorted))
+	for i, x := range sorted {
+		parts[i] = x.Key + "=" + x.Value
+	}
+	return strings.Join(parts, ",")
+}
+
+// Checksum returns the content digest ("sha256:<hex>") of the entry named
+// path within tarfilename, modeled after buildkit's contenthash.Checksum.
+// path is matched against the cleaned form of each entry's name.
+func Checksum(tarfilename, path string) (string, error) {
+	dat, err := ioutil.ReadFile(tarfilename)
+	if err != nil {
+		return "", err
+	}
+	clean := filepath.Clean(path)
+
+	tr := tar.NewReader(bytes.NewReader(dat))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if filepath.Clean(hdr.Name) != clean {
+			continue
+		}
+		var body bytes.Buffer
+		if _, err := io.Copy(&body, tr); err != nil {
+			return "", err
+		}
+		return contentDigest(body.Bytes()), nil
+	}
+	return "", fmt.Errorf("%s: no such entry in %s", path, tarfilename)
+}
+
+// VerifyTar streams tarfilename and checks every entry that has a declared
+// Digest in the metadata at yamlfilename, plus mfs.RootDigest if set. It
+// returns an error describing the first mismatch, or nil if everything
+// (that has a digest to check) matches.
+func VerifyTar(tarfilename, yamlfilename string, verbose bool) error {
+	yamldata, err := ioutil.ReadFile(yamlfilename)
+	if err != nil {
+		return err
+	}
+	mfs := MetaArchiveRegular{}
+	if err := yaml.Unmarshal(yamldata, &mfs); err != nil {
+		return err
+	}
+
+	dat, err := ioutil.ReadFile(tarfilename)
+	if err != nil {
+		return err
+	}
+
+	bodymap := make(map[string][]byte)
+	tr := tar.NewReader(bytes.NewReader(dat))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var body bytes.Buffer
+		if _, err := io.Copy(&body, tr); err != nil {
+			return err
+		}
+		bodymap[hdr.Name] = body.Bytes()
+	}
+
+	checked := 0
+	for _, mf := range mfs.Contents {
+		if mf.Digest == "" {
+			continue
+		}
+		body, ok := bodymap[mf.Filename]
+		if !ok {
+			return fmt.Errorf("%s: missing from %s", mf.Filename, tarfilename)
+		}
+		got := contentDigest(body)
+		if got != mf.Digest {
+			return fmt.Errorf("%s: digest mismatch: got %s, want %s", mf.Filename, got, mf.Digest)
+		}
+		checked++
+		if verbose {
+			fmt.Printf("%s: OK %s\n", mf.Filename, got)
+		}
+	}
+
+	recomputed := computeTreeDigests(mfs.Contents)
+	for i, mf := range mfs.Contents {
+		if mf.Type != "directory" || mf.TreeDigest == "" {
+			continue
+		}
+		got := recomputed[i].TreeDigest
+		if got != mf.TreeDigest {
+			return fmt.Errorf("%s: TreeDigest mismatch: got %s, want %s", mf.Filename, got, mf.TreeDigest)
+		}
+		checked++
+		if verbose {
+			fmt.Printf("%s: OK %s\n", mf.Filename, got)
+		}
+	}
+
+	if mfs.RootDigest != "" {
+		got := computeRootDigest(mfs.Contents)
+		if got != mfs.RootDigest {
+			return fmt.Errorf("RootDigest mismatch: got %s, want %s", got, mfs.RootDigest)
+		}
+		if verbose {
+			fmt.Printf("RootDigest: OK %s\n", got)
+		}
+	}
+
+	if verbose {
+		fmt.Printf("%s: %d of %d entries had a digest to verify\n", filepath.Base(yamlfilename), checked, len(mfs.Contents))
+	}
+	return nil
+}
+
+// whiteoutOpaqueMarker is the AUFS/OverlayFS convention for "this directory's
+// contents fully replace the same directory in the layer below".
+const whiteoutOpaqueMarker = ".wh..wh..opq"
+
+// whiteoutPrefix marks an AUFS-style "this file was deleted" entry: a
+// zero-length file named ".wh.<name>" in the same directory as <name>.
+const whiteoutPrefix = ".wh."
+
+// whiteoutTarget reports whether name is an AUFS-style whiteout marker, and
+// if so, what it targets: either a deleted entry's path (isOpaque false) or
+// the directory whose contents replace the lower layer's (isOpaque true).
+func whiteoutTarget(name string) (target string, isOpaque bool, ok bool) {
+	dir, base := filepath.Split(name)
+	if base == whiteoutOpaqueMarker {
+		return strings.TrimSuffix(dir, "/"), true, true
+	}
+	if strings.HasPrefix(base, whiteoutPrefix) {
+		return filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), false, true
+	}
+	return "", false, false
 }
 
 // Typeflag2string converts a given tar filetype byte to a string
@@ -327,6 +742,171 @@ func exists(filename string) bool {
 	return true
 }
 
+// Options carries the backend a metatar function should use to read and
+// write named files, so WriteMetadata, ApplyMetadataToTar,
+// ApplyMetadataToCpio and MergeMetadata can run against archives that live
+// somewhere other than the real filesystem (in memory, under a chroot-style
+// prefix, and so on). The input tar/cpio streams these functions decompress
+// on the fly are unaffected; Options governs the YAML metadata and the
+// final output file.
+type Options struct {
+	FS metafs.FS
+
+	// Reproducible makes ApplyMetadataToTar/Cpio write canonically: entries
+	// in sorted filename order, a fixed Format/mtime for anything that
+	// doesn't declare its own Mtime, and (with NumericOwner) no symbolic
+	// owner names, so two runs over the same inputs are byte-identical.
+	Reproducible bool
+	// SourceDateEpoch is the mtime (seconds since epoch) Reproducible
+	// stamps entries with when they don't declare their own Mtime, per
+	// https://reproducible-builds.org/specs/source-date-epoch/.
+	SourceDateEpoch int64
+	// NumericOwner clears Uname/Gname on tar entries, the --numeric-owner
+	// behavior from GNU tar; cpio entries are always numeric already.
+	NumericOwner bool
+}
+
+// DefaultOptions returns the Options metatar's CLI uses: a plain OsFs,
+// matching the behavior before Options existed.
+func DefaultOptions() Options {
+	return Options{FS: metafs.NewOsFs()}
+}
+
+// readFile reads the whole of name from opts.FS, the FS-backed equivalent
+// of ioutil.ReadFile.
+func readFile(opts Options, name string) ([]byte, error) {
+	f, err := opts.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// parseFSURL picks a metafs backend from url's scheme and returns it along
+// with the path that backend should use, stripped of the scheme prefix.
+// "file://<path>" uses the real filesystem (the default for a bare path,
+// with no scheme at all); "basepath://<dir>!<path>" confines reads and
+// writes under <dir>.
+func parseFSURL(url string) (metafs.FS, string) {
+	switch {
+	case strings.HasPrefix(url, "file://"):
+		return metafs.NewOsFs(), strings.TrimPrefix(url, "file://")
+	case strings.HasPrefix(url, "basepath://"):
+		rest := strings.TrimPrefix(url, "basepath://")
+		parts := strings.SplitN(rest, "!", 2)
+		if len(parts) != 2 {
+			quit(fmt.Sprintf("basepath:// URL must be of the form basepath://<dir>!<path>, got %q", url))
+		}
+		return metafs.NewBasePathFs(metafs.NewOsFs(), parts[0]), parts[1]
+	default:
+		return metafs.NewOsFs(), url
+	}
+}
+
+// writeFile writes data to name via opts.FS, refusing to overwrite an
+// existing file unless force is set, the FS-backed equivalent of
+// exists()+ioutil.WriteFile.
+func writeFile(opts Options, name string, data []byte, force bool) error {
+	if !force && metafs.Exists(opts.FS, name) {
+		quit(fmt.Sprintf("%s already exists", name))
+	}
+	f, err := opts.FS.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// blobCacheDir returns the local content-addressed blob cache that a
+// "sha256:<digest>" BodyRef is resolved against: "$XDG_CACHE_HOME/metatar"
+// if set, else "~/.cache/metatar".
+func blobCacheDir() string {
+	if xdg := os.Getenv("XDG_CACHE_HOME"); xdg != "" {
+		return filepath.Join(xdg, "metatar")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".cache", "metatar")
+	}
+	return filepath.Join(".cache", "metatar")
+}
+
+// resolveBodyRef fetches the bytes a MetaFileRegular/MetaFileExpanded's
+// BodyRef points at, so the caller can populate bodymap without bloating
+// the YAML with base64: "file:<path>" reads a file relative to yamlDir,
+// "http://" and "https://" fetch the body over HTTP, and "sha256:<digest>"
+// looks the blob up in blobCacheDir's "blobs/sha256/<digest>" (the same
+// layout storeBlob writes for --extract-bodies).
+// bodyRefHTTPClient is used for BodyRef's http:/https: scheme. A BodyRef
+// comes from a YAML manifest, which may be untrusted, so fetches are bounded
+// by a timeout to avoid hanging on an unresponsive or malicious server.
+var bodyRefHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// maxBodyRefHTTPBytes caps how much of an http:/https: BodyRef response is
+// read into memory, so a malicious or misbehaving server can't exhaust
+// memory via an unbounded or deliberately oversized response. A var, not a
+// const, so tests can shrink it rather than generate a 256 MiB response.
+var maxBodyRefHTTPBytes int64 = 256 << 20 // 256 MiB
+
+func resolveBodyRef(ref, yamlDir string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(ref, "file:"):
+		path := strings.TrimPrefix(ref, "file:")
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(yamlDir, path)
+		}
+		rel, err := filepath.Rel(filepath.Clean(yamlDir), path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("BodyRef %q escapes yaml directory %q", ref, yamlDir)
+		}
+		return ioutil.ReadFile(path)
+	case strings.HasPrefix(ref, "http://"), strings.HasPrefix(ref, "https://"):
+		resp, err := bodyRefHTTPClient.Get(ref)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status fetching %s: %s", ref, resp.Status)
+		}
+		limited := io.LimitReader(resp.Body, maxBodyRefHTTPBytes+1)
+		body, err := ioutil.ReadAll(limited)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(body)) > maxBodyRefHTTPBytes {
+			return nil, fmt.Errorf("BodyRef %s exceeds the %d byte limit", ref, maxBodyRefHTTPBytes)
+		}
+		return body, nil
+	case strings.HasPrefix(ref, "sha256:"):
+		digest := strings.TrimPrefix(ref, "sha256:")
+		return ioutil.ReadFile(filepath.Join(blobCacheDir(), "blobs", "sha256", digest))
+	default:
+		return nil, fmt.Errorf("unrecognized BodyRef scheme: %q", ref)
+	}
+}
+
+// storeBlob writes body to dir's content-addressed "blobs/sha256/<digest>"
+// layout, creating directories as needed, and returns the BodyRef that
+// points back at it. digest is the regular file's already-computed
+// "sha256:<hex>" content digest, so the blob's name and its Digest field
+// always agree.
+func storeBlob(dir, digest string, body []byte) (string, error) {
+	blobDir := filepath.Join(dir, "blobs", "sha256")
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		return "", err
+	}
+	hexDigest := strings.TrimPrefix(digest, "sha256:")
+	if err := ioutil.WriteFile(filepath.Join(blobDir, hexDigest), body, 0644); err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
 // Strip "Username:", "Groupname:", "UID:" and "GID:" lines from input
 func stripUserGroup(inputbuf bytes.Buffer) bytes.Buffer {
 	var buf bytes.Buffer
@@ -370,6 +950,7 @@ func tar2metadata(hdr *tar.Header, root bool) MetaFileExpanded {
 	}
 	m.Devmajor = hdr.Devmajor
 	m.Devminor = hdr.Devminor
+	m.Mtime = hdr.ModTime.Unix()
 
 	for k, v := range hdr.Xattrs {
 		x := Xattr{}
@@ -381,17 +962,41 @@ func tar2metadata(hdr *tar.Header, root bool) MetaFileExpanded {
 	return m
 }
 
-// WriteMetadata takes a tar archive and outputs a YAML file
-func WriteMetadata(tarfilename, yamlfilename string, force, withBody, verbose, expand, root, nouser bool) error {
+// WriteMetadata takes a tar archive and outputs a YAML file. If
+// extractBodiesDir is non-empty, each file's body is written into that
+// directory's content-addressed blob store (see storeBlob) and a BodyRef
+// is recorded instead of an inline base64 Body, keeping the YAML small.
+func WriteMetadata(tarfilename, yamlfilename string, force, withBody, verbose, expand, root, nouser, rawstream bool, extractBodiesDir string, opts Options) error {
 
-	dat, err := ioutil.ReadFile(tarfilename)
+	f, err := opts.FS.Open(tarfilename)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
-	// Open the tar archive for reading.
-	r := bytes.NewReader(dat)
-	tr := tar.NewReader(r)
+	// Stream the archive instead of reading it whole, auto-decompressing
+	// gzip/bzip2 on the fly, the same way ListTar/ApplyMetadataToTar do.
+	dr, err := archive.Decompress(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", tarfilename, err)
+	}
+
+	var sr *archive.StreamReader
+	if rawstream && yamlfilename != "-" {
+		// The rawstream sidecar needs the fully decompressed tar bytes (it
+		// tar-splits the raw stream), so buffer it here instead of
+		// streaming straight through.
+		dat, err := ioutil.ReadAll(dr)
+		if err != nil {
+			return err
+		}
+		if err := writeRawstreamSidecar(dat, yamlfilename, verbose); err != nil {
+			return err
+		}
+		sr = archive.NewStreamReader(bytes.NewReader(dat))
+	} else {
+		sr = archive.NewStreamReader(dr)
+	}
 
 	var (
 		x   Xattr        // For the Xattrs
@@ -412,7 +1017,7 @@ func WriteMetadata(tarfilename, yamlfilename string, force, withBody, verbose, e
 		// Iterate through the files in the archive.
 		for {
 
-			hdr, err := tr.Next()
+			entry, err := sr.Next()
 			if err == io.EOF {
 				// end of tar archive
 				break
@@ -420,6 +1025,26 @@ func WriteMetadata(tarfilename, yamlfilename string, force, withBody, verbose, e
 			if err != nil {
 				return err
 			}
+			hdr := entry.Header
+
+			if target, opaque, ok := whiteoutTarget(hdr.Name); ok {
+				if opaque {
+					folded := false
+					for i := range mfs.Contents {
+						if strings.TrimSuffix(mfs.Contents[i].Filename, "/") == target {
+							mfs.Contents[i].OpaqueDir = true
+							folded = true
+							break
+						}
+					}
+					if !folded {
+						mfs.Contents = append(mfs.Contents, MetaFileRegular{Filename: target, Type: "directory", OpaqueDir: true})
+					}
+				} else {
+					mfs.Contents = append(mfs.Contents, MetaFileRegular{Filename: target, Type: "regular file", Whiteout: true})
+				}
+				continue
+			}
 
 			m := MetaFileRegular{}
 			m.Filename = hdr.Name
@@ -439,6 +1064,7 @@ func WriteMetadata(tarfilename, yamlfilename string, force, withBody, verbose, e
 			}
 			m.Devmajor = hdr.Devmajor
 			m.Devminor = hdr.Devminor
+			m.Mtime = hdr.ModTime.Unix()
 
 			for k, v := range hdr.Xattrs {
 				x = Xattr{}
@@ -447,26 +1073,41 @@ func WriteMetadata(tarfilename, yamlfilename string, force, withBody, verbose, e
 				m.Xattrs = append(m.Xattrs, x)
 			}
 
-			// Store the file body as a base64 encoded string
+			// Read the file body, to compute its content digest and, if
+			// requested, store it as a base64 encoded string
+			var bodybuf bytes.Buffer
+			_, err = io.Copy(&bodybuf, entry.Body)
+			if err != nil {
+				return err
+			}
+			if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+				m.Digest = contentDigest(bodybuf.Bytes())
+			}
 			if withBody {
-				var bodybuf bytes.Buffer
-				_, err = io.Copy(&bodybuf, tr)
-				if err != nil {
-					return err
-				}
 				m.BodySize = len(bodybuf.Bytes())
 				if m.BodySize == 0 {
 					if verbose {
 						fmt.Println(hdr.Name + " is empty, body not written to YAML file")
 					}
 				}
-				m.Body = base64.StdEncoding.EncodeToString(bodybuf.Bytes())
+				if extractBodiesDir != "" && m.BodySize > 0 {
+					ref, err := storeBlob(extractBodiesDir, m.Digest, bodybuf.Bytes())
+					if err != nil {
+						return err
+					}
+					m.BodyRef = ref
+				} else {
+					m.Body = base64.StdEncoding.EncodeToString(bodybuf.Bytes())
+				}
 			}
 
 			// Append the metadata about a file to the collection
 			mfs.Contents = append(mfs.Contents, m)
 		}
 
+		mfs.Contents = computeTreeDigests(mfs.Contents)
+		mfs.RootDigest = computeRootDigest(mfs.Contents)
+
 		// Create YML code
 		if d, err := yaml.Marshal(&mfs); err != nil {
 			if err != nil {
@@ -487,7 +1128,7 @@ func WriteMetadata(tarfilename, yamlfilename string, force, withBody, verbose, e
 		// Iterate through the files in the archive.
 		for {
 
-			hdr, err := tr.Next()
+			entry, err := sr.Next()
 			if err == io.EOF {
 				// end of tar archive
 				break
@@ -495,29 +1136,79 @@ func WriteMetadata(tarfilename, yamlfilename string, force, withBody, verbose, e
 			if err != nil {
 				return err
 			}
+			hdr := entry.Header
+
+			if target, opaque, ok := whiteoutTarget(hdr.Name); ok {
+				if opaque {
+					folded := false
+					for i := range mfs.Contents {
+						if strings.TrimSuffix(mfs.Contents[i].Filename, "/") == target {
+							mfs.Contents[i].OpaqueDir = true
+							folded = true
+							break
+						}
+					}
+					if !folded {
+						mf := tar2metadata(hdr, root)
+						mf.Filename = target
+						mf.Type = "directory"
+						mf.OpaqueDir = true
+						mfs.Contents = append(mfs.Contents, mf)
+					}
+				} else {
+					mf := tar2metadata(hdr, root)
+					mf.Filename = target
+					mf.Type = "regular file"
+					mf.Whiteout = true
+					mfs.Contents = append(mfs.Contents, mf)
+				}
+				continue
+			}
 
 			m := tar2metadata(hdr, root)
 
-			// Store the file body as a base64 encoded string
+			// Read the file body, to compute its content digest and, if
+			// requested, store it as a base64 encoded string
+			var bodybuf bytes.Buffer
+			_, err = io.Copy(&bodybuf, entry.Body)
+			if err != nil {
+				return err
+			}
+			if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+				m.Digest = contentDigest(bodybuf.Bytes())
+			}
 			if withBody {
-				var bodybuf bytes.Buffer
-				_, err = io.Copy(&bodybuf, tr)
-				if err != nil {
-					return err
-				}
 				m.BodySize = len(bodybuf.Bytes())
 				if m.BodySize == 0 {
 					if verbose {
 						fmt.Println(hdr.Name + " is empty, body not written to YAML file")
 					}
 				}
-				m.Body = base64.StdEncoding.EncodeToString(bodybuf.Bytes())
+				if extractBodiesDir != "" && m.BodySize > 0 {
+					ref, err := storeBlob(extractBodiesDir, m.Digest, bodybuf.Bytes())
+					if err != nil {
+						return err
+					}
+					m.BodyRef = ref
+				} else {
+					m.Body = base64.StdEncoding.EncodeToString(bodybuf.Bytes())
+				}
 			}
 
 			// Append the metadata about a file to the collection
 			mfs.Contents = append(mfs.Contents, m)
 		}
 
+		regular := make([]MetaFileRegular, len(mfs.Contents))
+		for i, mf := range mfs.Contents {
+			regular[i] = MetaFileRegular(mf)
+		}
+		regular = computeTreeDigests(regular)
+		for i, mf := range regular {
+			mfs.Contents[i] = MetaFileExpanded(mf)
+		}
+		mfs.RootDigest = computeRootDigestExpanded(mfs.Contents)
+
 		// Create YML code
 		if d, err := yaml.Marshal(&mfs); err != nil {
 			if err != nil {
@@ -540,12 +1231,8 @@ func WriteMetadata(tarfilename, yamlfilename string, force, withBody, verbose, e
 		// Write to stdout
 		fmt.Print(buf.String())
 	} else {
-		// Check if the YAML file exists first
-		if !force && exists(yamlfilename) {
-			quit(fmt.Sprintf("%s already exists", yamlfilename))
-		}
 		// Write the YAML file
-		if ioutil.WriteFile(yamlfilename, buf.Bytes(), 0644) != nil {
+		if err := writeFile(opts, yamlfilename, buf.Bytes(), force); err != nil {
 			return err
 		}
 	}
@@ -556,19 +1243,24 @@ func WriteMetadata(tarfilename, yamlfilename string, force, withBody, verbose, e
 // ListTar takes a tar archive and lists the contents
 func ListTar(filename string) error {
 	//fmt.Printf("\n--- Contents of %s ---\n\n", filename)
-	dat, err := ioutil.ReadFile(filename)
+	f, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
-	// Open the tar archive for reading.
-	r := bytes.NewReader(dat)
-	tr := tar.NewReader(r)
+	// Stream the archive instead of reading it whole: ListTar only ever
+	// needs one entry's header and body size at a time.
+	dr, err := archive.Decompress(f)
+	if err != nil {
+		return err
+	}
+	sr := archive.NewStreamReader(dr)
 
 	// Loop through the files in the input tar archive.
 	prevname := ""
 	for {
-		hdr, err := tr.Next()
+		entry, err := sr.Next()
 		if err == io.EOF {
 			// End of tar
 			break
@@ -576,6 +1268,7 @@ func ListTar(filename string) error {
 		if err != nil {
 			return errors.New(filename + ": after: " + prevname + ": " + err.Error())
 		}
+		hdr := entry.Header
 
 		prevname = hdr.Name
 		fmt.Printf("%s:\n", hdr.Name)
@@ -596,12 +1289,11 @@ func ListTar(filename string) error {
 			fmt.Printf("\tXattrs for %s: %s=%s\n", hdr.Name, k, v)
 		}
 
-		var bodybuf bytes.Buffer
-		_, err = io.Copy(&bodybuf, tr)
+		size, err := io.Copy(io.Discard, entry.Body)
 		if err != nil {
 			return err
 		}
-		fmt.Printf("\tSize: %v\n", len(bodybuf.Bytes()))
+		fmt.Printf("\tSize: %v\n", size)
 	}
 	return nil
 }
@@ -609,14 +1301,19 @@ func ListTar(filename string) error {
 // ListCPIO takes a cpio (newc) archive and lists the contents
 func ListCPIO(filename string) error {
 	//fmt.Printf("\n--- Contents of %s ---\n\n", filename)
-	dat, err := ioutil.ReadFile(filename)
+	f, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
-	// Open the tar archive for reading.
-	r := bytes.NewReader(dat)
-	gr := cpio.NewReader(r)
+	// Stream the archive instead of reading it whole, auto-decompressing
+	// gzip/bzip2 on the fly, the same way ListTar does.
+	dr, err := archive.Decompress(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	gr := cpio.NewReader(dr)
 
 	// Loop through the files in the input tar archive.
 	prevname := ""
@@ -668,10 +1365,10 @@ func ListCPIO(filename string) error {
 
 // ApplyMetadataToTar takes a tar archive and a YAML metadata file. It then applies
 // all the metadata to the tar archive contents and outputs a new tar archive.
-func ApplyMetadataToTar(tarfilename, yamlfilename, newfilename string, force, withBody, verbose, skipEmptyFiles bool) error {
+func ApplyMetadataToTar(tarfilename, yamlfilename, newfilename, rulesetPath string, force, withBody, verbose, skipEmptyFiles, rawstream, overlayWhiteout bool, compress string, opts Options) error {
 
 	// Read the metadata
-	yamldata, err := ioutil.ReadFile(yamlfilename)
+	yamldata, err := readFile(opts, yamlfilename)
 	if err != nil {
 		return err
 	}
@@ -689,20 +1386,109 @@ func ApplyMetadataToTar(tarfilename, yamlfilename, newfilename string, force, wi
 		}
 	}
 
-	// Store the files in the input archive in a map
-	bodymap := make(map[string][]byte)
-	// Store if files are copied over in this map
-	donemap := make(map[string]bool)
+	if rawstream {
+		return applyRawstream(yamlfilename, newfilename, force, &mfs)
+	}
 
-	// Skip the input tar file if the filename is empty
-	if tarfilename != "" {
+	if err := applyRuleset(rulesetPath, yamlfilename, verbose, &mfs); err != nil {
+		return err
+	}
+
+	applyWhiteouts(&mfs, overlayWhiteout)
+
+	// Check if the TAR file exists first
+	if !force && metafs.Exists(opts.FS, newfilename) {
+		quit(fmt.Sprintf("%s already exists", newfilename))
+	}
 
-		// Read the input tarfile
-		dat, err := ioutil.ReadFile(tarfilename)
+	// Skip the input tar file if the filename is empty. Otherwise, stream it
+	// in (auto-decompressing gzip/bzip2 on the fly) instead of reading the
+	// whole compressed file into memory first.
+	var r io.Reader
+	if tarfilename != "" {
+		f, err := opts.FS.Open(tarfilename)
 		if err != nil {
 			return err
 		}
-		r := bytes.NewReader(dat)
+		defer f.Close()
+		dr, err := archive.Decompress(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", tarfilename, err)
+		}
+		r = dr
+	}
+
+	out, err := opts.FS.Create(newfilename)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if compress == "" {
+		compress = archive.DetectCompressionFromName(newfilename)
+	}
+	cw, err := archive.CompressWriter(out, compress)
+	if err != nil {
+		return fmt.Errorf("%s: %w", newfilename, err)
+	}
+
+	tw := tar.NewWriter(cw)
+	if err := writeTarFromMeta(tw, &mfs, r, tarfilename, yamlfilename, withBody, verbose, skipEmptyFiles, opts); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// buildTarFromMeta writes mfs.Contents out as a tar archive and returns the
+// result as an in-memory buffer, without touching newfilename. It is used
+// by GenerateOCIImage, which needs the whole uncompressed tar in memory
+// anyway to compute its DiffID and gzip it into an OCI layer blob. Callers
+// are expected to have already run applyRuleset and applyWhiteouts on mfs.
+func buildTarFromMeta(mfs *MetaArchiveRegular, tarfilename, yamlfilename string, withBody, verbose, skipEmptyFiles bool) (*bytes.Buffer, error) {
+	var r io.Reader
+	if tarfilename != "" {
+		f, err := os.Open(tarfilename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		dr, err := archive.Decompress(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", tarfilename, err)
+		}
+		r = dr
+	}
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	if err := writeTarFromMeta(tw, mfs, r, tarfilename, yamlfilename, withBody, verbose, skipEmptyFiles, DefaultOptions()); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// writeTarFromMeta is the shared core of buildTarFromMeta and
+// ApplyMetadataToTar's streaming path: it writes mfs.Contents to tw as tar
+// entries, reading any corresponding input file bodies from r (the
+// decompressed input tar stream, or nil if there is none). The caller owns
+// tw and must Close it. tarname is only used to label error messages and
+// verbose output, since r may no longer be directly associated with a file
+// (e.g. after decompression). When opts.Reproducible is set, entries are
+// written in canonical filename order with a fixed Format and mtime, see
+// ApplyMetadataToTar's --reproducible/--source-date-epoch/--numeric-owner.
+func writeTarFromMeta(tw *tar.Writer, mfs *MetaArchiveRegular, r io.Reader, tarname, yamlfilename string, withBody, verbose, skipEmptyFiles bool, opts Options) error {
+	// Store the files in the input archive in a map
+	bodymap := make(map[string][]byte)
+	// Store if files are copied over in this map
+	donemap := make(map[string]bool)
+
+	if r != nil {
 		tr := tar.NewReader(r)
 
 		// Loop over all files in the input tar archive
@@ -713,7 +1499,7 @@ func ApplyMetadataToTar(tarfilename, yamlfilename, newfilename string, force, wi
 				break
 			}
 			if err != nil {
-				return errors.New(tarfilename + ": " + err.Error())
+				return errors.New(tarname + ": " + err.Error())
 			}
 			var bodybuf bytes.Buffer
 			if _, err = io.Copy(&bodybuf, tr); err != nil {
@@ -721,17 +1507,18 @@ func ApplyMetadataToTar(tarfilename, yamlfilename, newfilename string, force, wi
 			}
 			bodymap[hdr.Name] = bodybuf.Bytes()
 		}
-
 	}
 
-	// Create a buffer to write our new archive to.
-	buf := new(bytes.Buffer)
-
-	// Create a new tar archive.
-	tw := tar.NewWriter(buf)
-
 	// Loop through the files in the metadata and write the corresponding file to the tar
-	for _, mf := range mfs.Contents {
+	contents := mfs.Contents
+	if opts.Reproducible {
+		contents = sortedByFilename(contents)
+	}
+	defaultMtime := time.Now().Unix()
+	if opts.Reproducible {
+		defaultMtime = opts.SourceDateEpoch
+	}
+	for _, mf := range contents {
 		emptyRegularFile := false
 		if hasl(mfs.SkipList, mf.Filename) || hasglob(mfs.SkipList, mf.Filename) {
 			mf.Skip = true
@@ -749,10 +1536,11 @@ func ApplyMetadataToTar(tarfilename, yamlfilename, newfilename string, force, wi
 			continue
 		}
 		if _, ok := bodymap[mf.Filename]; !ok {
+			// Whether this ends up empty is only known for sure once Body
+			// (below) and Transforms have had a chance to fill bodymap, so
+			// this is just for the verbose message; the real skip decision
+			// is made right before the entry is written.
 			emptyRegularFile = len(bodymap[mf.Filename]) == 0 && (mf.Type == "regular file" || mf.Type == "regular file (A)")
-			if emptyRegularFile && skipEmptyFiles {
-				continue
-			}
 			if verbose {
 				user := mf.Username
 				if user == "" {
@@ -781,7 +1569,7 @@ func ApplyMetadataToTar(tarfilename, yamlfilename, newfilename string, force, wi
 			headerFilename = mf.Rename
 			if _, ok := bodymap[mf.Rename]; ok {
 				if verbose {
-					fmt.Printf("%s: rename %s -> %s: %s already exists in %s!\n", filepath.Base(yamlfilename), mf.Filename, mf.Rename, mf.Rename, tarfilename)
+					fmt.Printf("%s: rename %s -> %s: %s already exists in %s!\n", filepath.Base(yamlfilename), mf.Filename, mf.Rename, mf.Rename, tarname)
 				}
 			} else {
 				// Make sure the renamed file exists in the bodymap too, since it's used for checking later on
@@ -802,31 +1590,29 @@ func ApplyMetadataToTar(tarfilename, yamlfilename, newfilename string, force, wi
 				}
 				bodymap[mf.Filename] = b
 			}
+		} else if withBody && mf.BodyRef != "" {
+			b, err := resolveBodyRef(mf.BodyRef, filepath.Dir(yamlfilename))
+			if err != nil {
+				quit(fmt.Sprintf("%s: could not resolve BodyRef %s: %s", mf.Filename, mf.BodyRef, err.Error()))
+			}
+			if mf.BodySize > 0 && len(b) != mf.BodySize {
+				quit(fmt.Sprintf("%s: size is wrong for %s: %d != %d", filepath.Base(yamlfilename), mf.Filename, len(b), mf.BodySize))
+			}
+			bodymap[mf.Filename] = b
 		}
 
+		// StripEmptyLines/StripComments are shorthand for the equivalent
+		// named steps in Transforms, kept for backward-compatible YAML.
 		if mf.StripEmptyLines {
-			// Strip empty lines from the data in bodymap[mf.Filename]
-			s := string(bodymap[mf.Filename])
-			re, err := regexp.Compile("\n\n")
+			b, err := (stripEmptyLinesTransform{}).Apply(nil, bodymap[mf.Filename])
 			check(err)
-			bodymap[mf.Filename] = []byte(re.ReplaceAllString(s, "\n"))
+			bodymap[mf.Filename] = b
 		}
 
 		if mf.StripComments {
-			// Remove bash comments, skip the first line
-			s := string(bodymap[mf.Filename])
-			l := []string{}
-			for _, line := range strings.Split(s, "\n") {
-				if strings.HasPrefix(line, "#!") {
-					l = append(l, line)
-					continue
-				}
-				if strings.HasPrefix(strings.TrimSpace(line), "#") {
-					continue
-				}
-				l = append(l, line)
-			}
-			bodymap[mf.Filename] = []byte(strings.Join(l, "\n"))
+			b, err := (stripCommentsTransform{}).Apply(nil, bodymap[mf.Filename])
+			check(err)
+			bodymap[mf.Filename] = b
 		}
 
 		mode := mf.Mode.Int64()
@@ -855,12 +1641,53 @@ func ApplyMetadataToTar(tarfilename, yamlfilename, newfilename string, force, wi
 			Devminor: mf.Devminor,
 			Size:     int64(len(bodymap[mf.Filename])), // Get size from corresponding file in tarfilename
 		}
-		for _, xattr := range mf.Xattrs {
-			hdr.Xattrs[xattr.Key] = xattr.Value
+		if mf.Mtime != 0 {
+			hdr.ModTime = time.Unix(mf.Mtime, 0)
+		} else if opts.Reproducible {
+			hdr.ModTime = time.Unix(defaultMtime, 0)
+		}
+		if opts.NumericOwner {
+			hdr.Uname, hdr.Gname = "", ""
+		}
+		if opts.Reproducible {
+			hdr.Format = tar.FormatPAX
+		}
+		if len(mf.Xattrs) > 0 {
+			hdr.Xattrs = make(map[string]string, len(mf.Xattrs))
+			for _, xattr := range mf.Xattrs {
+				hdr.Xattrs[xattr.Key] = xattr.Value
+			}
+		}
+
+		if len(mf.Transforms) > 0 {
+			newBody, err := applyTransforms(hdr, bodymap[mf.Filename], mf.Transforms)
+			if err != nil {
+				quit(fmt.Sprintf("%s: %s", mf.Filename, err.Error()))
+			}
+			bodymap[mf.Filename] = newBody
+			hdr.Size = int64(len(newBody))
+		}
+
+		// If the metadata declares a Digest, the body that's about to be
+		// written (after Body and Transforms) must match it, or the YAML
+		// manifest and the archive being built have drifted apart.
+		if mf.Digest != "" && (mf.Type == "regular file" || mf.Type == "regular file (A)") {
+			if got := contentDigest(bodymap[mf.Filename]); got != mf.Digest {
+				msg := fmt.Sprintf("%s: digest mismatch: got %s, want %s", mf.Filename, got, mf.Digest)
+				if verbose {
+					fmt.Println("warning: " + msg)
+				} else {
+					return errors.New(msg)
+				}
+			}
 		}
 
-		// Extra skip check before writing header and body
-		if !(skipEmptyFiles && emptyRegularFile) {
+		// The final skip decision, now that Body and Transforms have had
+		// their say on bodymap[mf.Filename]. A Whiteout marker file
+		// (".wh.<name>") is empty by convention, not by accident, so
+		// --noskip-empty-files must not drop it.
+		emptyRegularFile = len(bodymap[mf.Filename]) == 0 && (mf.Type == "regular file" || mf.Type == "regular file (A)")
+		if !(skipEmptyFiles && emptyRegularFile && !mf.Whiteout) {
 			if err := tw.WriteHeader(hdr); err != nil {
 				return err
 			}
@@ -871,24 +1698,236 @@ func ApplyMetadataToTar(tarfilename, yamlfilename, newfilename string, force, wi
 
 		donemap[mf.Filename] = true
 	}
-	if err := tw.Close(); err != nil {
-		quiterr(err)
-	}
 
 	for filename, done := range donemap {
 		if !done {
 			if verbose {
-				fmt.Printf("%s from %s was skipped!", filename, tarfilename)
+				fmt.Printf("%s from %s was skipped!", filename, tarname)
 			}
 		}
 	}
 
-	// Check if the TAR file exists first
-	if !force && exists(newfilename) {
-		quit(fmt.Sprintf("%s already exists", newfilename))
+	return nil
+}
+
+// OCI media types, as defined by the OCI Image Format Specification.
+const (
+	ociMediaTypeLayer    = "application/vnd.oci.image.layer.v1.tar+gzip"
+	ociMediaTypeConfig   = "application/vnd.oci.image.config.v1+json"
+	ociMediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	ociMediaTypeIndex    = "application/vnd.oci.image.index.v1+json"
+)
+
+// ociDescriptor is an OCI content descriptor, as embedded in manifest.json,
+// config.json's rootfs and index.json.
+type ociDescriptor struct {
+	MediaType string       `json:"mediaType"`
+	Digest    string       `json:"digest"`
+	Size      int64        `json:"size"`
+	Platform  *ociPlatform `json:"platform,omitempty"`
+}
+
+// ociPlatform identifies the architecture and OS an image manifest was built for.
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+// ociManifest is an OCI image manifest: a config blob plus an ordered list of layer blobs.
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// ociIndex is the top-level entrypoint of an OCI image layout, listing the manifests it contains.
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// ociHistoryEntry is one entry in config.json's history array.
+type ociHistoryEntry struct {
+	Created    string `json:"created,omitempty"`
+	CreatedBy  string `json:"created_by,omitempty"`
+	Comment    string `json:"comment,omitempty"`
+	EmptyLayer bool   `json:"empty_layer,omitempty"`
+}
+
+// ociRootFS lists the DiffIDs (digests of the uncompressed layer tars, in
+// application order) that reconstruct the image's root filesystem.
+type ociRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// ociConfig is an OCI image config: the image's platform plus the rootfs and
+// history needed to reconstruct and describe it.
+type ociConfig struct {
+	Architecture string            `json:"architecture"`
+	OS           string            `json:"os"`
+	Config       map[string]string `json:"config"`
+	RootFS       ociRootFS         `json:"rootfs"`
+	History      []ociHistoryEntry `json:"history,omitempty"`
+}
+
+// GenerateOCIImage builds an OCI image layout directory at outputdir from
+// one or more layer YAML files. Each YAML file is processed the same way as
+// --generate (reusing buildTarFromMeta, applyRuleset and applyWhiteouts), so
+// its Contents become one gzipped tar layer, written to blobs/sha256/ as a
+// content-addressed blob named after its Digest (the sha256 of the gzipped
+// blob). The layer's DiffID (the sha256 of the uncompressed tar) is recorded
+// in config.json's rootfs.diff_ids, in the same order as the YAML files were
+// given. Each YAML file's optional "History:" list becomes that layer's
+// entries in config.json's history; a YAML file with no History gets a
+// single generated entry instead, so every layer is always accounted for.
+func GenerateOCIImage(yamlfilenames []string, outputdir, rulesetPath string, force, verbose, overlayWhiteout bool) error {
+	blobsDir := filepath.Join(outputdir, "blobs", "sha256")
+	if err := os.MkdirAll(blobsDir, 0755); err != nil {
+		return err
+	}
+
+	var diffIDs []string
+	var history []ociHistoryEntry
+	var layers []ociDescriptor
+	created := time.Now().UTC().Format(time.RFC3339)
+
+	for _, yamlfilename := range yamlfilenames {
+		yamldata, err := ioutil.ReadFile(yamlfilename)
+		if err != nil {
+			return err
+		}
+		mfs := MetaArchiveRegular{}
+		if err := yaml.Unmarshal(yamldata, &mfs); err != nil {
+			return err
+		}
+		if err := applyRuleset(rulesetPath, yamlfilename, verbose, &mfs); err != nil {
+			return err
+		}
+		applyWhiteouts(&mfs, overlayWhiteout)
+
+		tarbuf, err := buildTarFromMeta(&mfs, "", yamlfilename, true, verbose, true)
+		if err != nil {
+			return err
+		}
+		diffID := contentDigest(tarbuf.Bytes())
+		diffIDs = append(diffIDs, diffID)
+
+		var gzbuf bytes.Buffer
+		gw := gzip.NewWriter(&gzbuf)
+		if _, err := gw.Write(tarbuf.Bytes()); err != nil {
+			return err
+		}
+		if err := gw.Close(); err != nil {
+			return err
+		}
+		layerDigest := contentDigest(gzbuf.Bytes())
+		if err := writeOCIBlob(blobsDir, layerDigest, gzbuf.Bytes()); err != nil {
+			return err
+		}
+		layers = append(layers, ociDescriptor{
+			MediaType: ociMediaTypeLayer,
+			Digest:    layerDigest,
+			Size:      int64(gzbuf.Len()),
+		})
+
+		if len(mfs.History) == 0 {
+			history = append(history, ociHistoryEntry{
+				Created:   created,
+				CreatedBy: fmt.Sprintf("metatar --oci %s", filepath.Base(yamlfilename)),
+			})
+		} else {
+			for _, h := range mfs.History {
+				history = append(history, ociHistoryEntry{Created: created, CreatedBy: h.CreatedBy, Comment: h.Comment})
+			}
+		}
+
+		if verbose {
+			fmt.Printf("%s: layer %s (%d bytes compressed, diffID %s)\n", filepath.Base(yamlfilename), layerDigest, gzbuf.Len(), diffID)
+		}
+	}
+
+	cfg := ociConfig{
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
+		Config:       map[string]string{},
+		RootFS:       ociRootFS{Type: "layers", DiffIDs: diffIDs},
+		History:      history,
+	}
+	cfgBytes, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
 	}
-	// Write the new tarfile
-	return ioutil.WriteFile(newfilename, buf.Bytes(), 0644)
+	cfgDigest := contentDigest(cfgBytes)
+	if err := writeOCIBlob(blobsDir, cfgDigest, cfgBytes); err != nil {
+		return err
+	}
+	if err := writeOCIFile(filepath.Join(outputdir, "config.json"), cfgBytes, force); err != nil {
+		return err
+	}
+
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociMediaTypeManifest,
+		Config:        ociDescriptor{MediaType: ociMediaTypeConfig, Digest: cfgDigest, Size: int64(len(cfgBytes))},
+		Layers:        layers,
+	}
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	manifestDigest := contentDigest(manifestBytes)
+	if err := writeOCIBlob(blobsDir, manifestDigest, manifestBytes); err != nil {
+		return err
+	}
+	if err := writeOCIFile(filepath.Join(outputdir, "manifest.json"), manifestBytes, force); err != nil {
+		return err
+	}
+
+	index := ociIndex{
+		SchemaVersion: 2,
+		MediaType:     ociMediaTypeIndex,
+		Manifests: []ociDescriptor{{
+			MediaType: ociMediaTypeManifest,
+			Digest:    manifestDigest,
+			Size:      int64(len(manifestBytes)),
+			Platform:  &ociPlatform{Architecture: runtime.GOARCH, OS: runtime.GOOS},
+		}},
+	}
+	indexBytes, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeOCIFile(filepath.Join(outputdir, "index.json"), indexBytes, force); err != nil {
+		return err
+	}
+
+	return writeOCIFile(filepath.Join(outputdir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`+"\n"), force)
+}
+
+// writeOCIBlob writes data to blobsDir under its own digest, the way every
+// blob in an OCI image layout is named. Blobs are content-addressed, so an
+// existing blob with the same digest already holds identical content and is
+// left untouched rather than treated as a --force conflict.
+func writeOCIBlob(blobsDir, digest string, data []byte) error {
+	path := filepath.Join(blobsDir, strings.TrimPrefix(digest, "sha256:"))
+	if exists(path) {
+		return nil
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// writeOCIFile writes one of the human-readable top-level files
+// (config.json, manifest.json, index.json, oci-layout) that mirror a blob's
+// content for convenience, refusing to overwrite an existing file unless
+// force is set, same as every other metatar output.
+func writeOCIFile(path string, data []byte, force bool) error {
+	if !force && exists(path) {
+		quit(fmt.Sprintf("%s already exists", path))
+	}
+	return ioutil.WriteFile(path, data, 0644)
 }
 
 // Add a file to a CPIO archive by writing to a cpio.Writer,
@@ -901,7 +1940,7 @@ func ApplyMetadataToTar(tarfilename, yamlfilename, newfilename string, force, wi
 // withBody is if the file body from the metadata should be used, if present.
 // verbose gives more verbose output along the way.
 // Returns nil if everything worked out fine.
-func addFileToCPIO(cw *cpio.Writer, mf MetaFileExpanded, tarfilename, yamlfilename string, bodymap map[string][]byte, metamap map[string]MetaFileExpanded, skipmap, donemap, renmap, dirmap map[string]bool, mtime int64, withBody, verbose, declaredInYAML, skipEmptyFiles bool, ssf ShouldSkipFunc) error {
+func addFileToCPIO(cw cpioHeaderWriter, mf MetaFileExpanded, tarfilename, yamlfilename string, bodymap map[string][]byte, metamap map[string]MetaFileExpanded, skipmap, donemap, renmap, dirmap map[string]bool, mtime int64, withBody, verbose, declaredInYAML, skipEmptyFiles bool, ssf ShouldSkipFunc) error {
 	emptyRegularFile := false
 	if mf.Skip {
 		if verbose {
@@ -917,11 +1956,11 @@ func addFileToCPIO(cw *cpio.Writer, mf MetaFileExpanded, tarfilename, yamlfilena
 		return nil
 	}
 	if _, ok := bodymap[mf.Filename]; !ok {
+		// Whether this ends up empty is only known for sure once Body
+		// (below) has had a chance to fill bodymap, so this is just for
+		// the verbose message; the real skip decision is made right
+		// before the entry is written.
 		emptyRegularFile = len(bodymap[mf.Filename]) == 0 && (mf.Type == "regular file" || mf.Type == "regular file (A)")
-		if emptyRegularFile && skipEmptyFiles {
-			// Skip empty regular files
-			return nil
-		}
 		if verbose {
 			user := mf.Username
 			if user == "" {
@@ -1012,6 +2051,16 @@ func addFileToCPIO(cw *cpio.Writer, mf MetaFileExpanded, tarfilename, yamlfilena
 			bodymap[mf.Filename] = b
 			metamap[mf.Filename] = mf
 		}
+	} else if withBody && mf.BodyRef != "" {
+		b, err := resolveBodyRef(mf.BodyRef, filepath.Dir(yamlfilename))
+		if err != nil {
+			quit(fmt.Sprintf("%s: could not resolve BodyRef %s: %s", mf.Filename, mf.BodyRef, err.Error()))
+		}
+		if mf.BodySize > 0 && len(b) != mf.BodySize {
+			quit(fmt.Sprintf("%s: size is wrong for %s: %d != %d", filepath.Base(yamlfilename), mf.Filename, len(b), mf.BodySize))
+		}
+		bodymap[mf.Filename] = b
+		metamap[mf.Filename] = mf
 	}
 
 	if mf.StripEmptyLines {
@@ -1064,12 +2113,17 @@ func addFileToCPIO(cw *cpio.Writer, mf MetaFileExpanded, tarfilename, yamlfilena
 		}
 	}
 
+	entryMtime := mtime
+	if mf.Mtime != 0 {
+		entryMtime = mf.Mtime
+	}
+
 	hdr := &cpio.Header{
 		Name:     headerFilename,
 		Mode:     mode,
 		Uid:      mf.UID,
 		Gid:      mf.GID,
-		Mtime:    mtime,
+		Mtime:    entryMtime,
 		Size:     int64(len(bodymap[mf.Filename])), // Get size from corresponding file in tarfilename
 		Devmajor: mf.Devmajor,
 		Devminor: mf.Devminor,
@@ -1153,8 +2207,26 @@ func addFileToCPIO(cw *cpio.Writer, mf MetaFileExpanded, tarfilename, yamlfilena
 		return nil
 	}
 
-	// Extra skip check
-	if !(skipEmptyFiles && emptyRegularFile) {
+	// If the metadata declares a Digest, the body that's about to be
+	// written must match it, or the YAML manifest and the archive being
+	// built have drifted apart.
+	if mf.Digest != "" && (mf.Type == "regular file" || mf.Type == "regular file (A)") {
+		if got := contentDigest(bodymap[mf.Filename]); got != mf.Digest {
+			msg := fmt.Sprintf("%s: digest mismatch: got %s, want %s", mf.Filename, got, mf.Digest)
+			if verbose {
+				fmt.Println("warning: " + msg)
+			} else {
+				return errors.New(msg)
+			}
+		}
+	}
+
+	// The final skip decision, now that Body has had its say on
+	// bodymap[mf.Filename]. A Whiteout marker file (".wh.<name>") is empty
+	// by convention, not by accident, so --noskip-empty-files must not
+	// drop it.
+	emptyRegularFile = len(bodymap[mf.Filename]) == 0 && (mf.Type == "regular file" || mf.Type == "regular file (A)")
+	if !(skipEmptyFiles && emptyRegularFile && !mf.Whiteout) {
 		// Write the header
 		if err := cw.WriteHeader(hdr); err != nil {
 			return err
@@ -1176,7 +2248,8 @@ func addFileToCPIO(cw *cpio.Writer, mf MetaFileExpanded, tarfilename, yamlfilena
 	return nil
 }
 
-// Given a slice of strings and a string, figure out if the string is present
+// Given a slice of strings and a string, figure out if the string is present.
+// For ordered include/exclude rules with negation, use Selector instead.
 func hasl(l []string, e string) bool {
 	for _, x := range l {
 		if x == e {
@@ -1186,18 +2259,173 @@ func hasl(l []string, e string) bool {
 	return false
 }
 
-// Given a slice of strings that are regular expressions, and a string, figure out if the string matches any of the regular expressions
+// Given a slice of strings that are glob patterns, and a string, figure out
+// if the string matches any of the patterns. For ordered include/exclude
+// rules with negation, use Selector instead.
 func hasglob(l []string, e string) bool {
 	for _, globexpr := range l {
-		g, err := glob.Compile(globexpr)
+		if matchGlobPattern(globexpr, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectorEntry is one (pattern, polarity) entry in a Selector.
+type selectorEntry struct {
+	pattern string
+	negate  bool // true for a "!pattern" entry, meaning "re-include"
+}
+
+// Selector matches paths against an ordered list of include/exclude
+// patterns, gitignore-style: entries are evaluated in the order given, and
+// the last matching entry decides whether a path is kept. A plain pattern
+// excludes matching paths; a pattern prefixed with "!" re-includes them,
+// which lets a later, more specific rule override an earlier, broader one
+// (e.g. "src/**", "!src/vendor/**").
+type Selector struct {
+	entries []selectorEntry
+}
+
+// NewSelector builds a Selector from patterns in the given order.
+func NewSelector(patterns []string) (*Selector, error) {
+	s := &Selector{}
+	for _, p := range patterns {
+		negate := strings.HasPrefix(p, "!")
+		pattern := strings.TrimPrefix(p, "!")
+		if pattern == "" {
+			return nil, errors.New("empty glob pattern")
+		}
+		if _, err := glob.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %s", p, err.Error())
+		}
+		s.entries = append(s.entries, selectorEntry{pattern: pattern, negate: negate})
+	}
+	return s, nil
+}
+
+// Matches reports whether path is selected (kept). With no entries, or if no
+// entry matches path, the path is kept; otherwise the last matching entry's
+// polarity decides.
+func (s *Selector) Matches(path string) bool {
+	keep := true
+	for _, e := range s.entries {
+		if matchGlobPattern(e.pattern, path) {
+			keep = e.negate
+		}
+	}
+	return keep
+}
+
+// matchGlobPattern reports whether e matches the given glob pattern. Patterns
+// containing "**" are compiled with "/" as the separator, so that "**" matches
+// zero or more path segments (gitignore-style), while a plain "*" still only
+// matches within a single segment. A bare "**" at the start or end of the
+// pattern also matches when that side of the path is empty, so "**/foo"
+// matches "foo" and "foo/**" matches "foo".
+func matchGlobPattern(pattern, e string) bool {
+	if !strings.Contains(pattern, "**") {
+		g, err := glob.Compile(pattern)
+		check(err)
+		return g.Match(e)
+	}
+
+	g, err := glob.Compile(pattern, '/')
+	check(err)
+	if g.Match(e) {
+		return true
+	}
+
+	if trimmed := strings.TrimPrefix(pattern, "**/"); trimmed != pattern && matchGlobPattern(trimmed, e) {
+		return true
+	}
+	if trimmed := strings.TrimSuffix(pattern, "/**"); trimmed != pattern && matchGlobPattern(trimmed, e) {
+		return true
+	}
+
+	return false
+}
+
+// Dialect selects which glob syntax a Matcher uses.
+type Dialect int
+
+const (
+	// DialectGlob is metatar's native dialect: gobwas/glob, with the "**"
+	// recursive-segment extension implemented by matchGlobPattern.
+	DialectGlob Dialect = iota
+	// DialectMatrix is the dialect used by the Matrix push-rule spec: "*"
+	// matches any run of characters (including "/"), "?" matches exactly
+	// one character, and there is no "**".
+	DialectMatrix
+)
+
+// Matcher matches strings against a single pattern, in a chosen Dialect.
+// It lets metatar be embedded in tools that already express selection rules
+// in the Matrix push-rule glob syntax, without rewriting them.
+type Matcher struct {
+	Dialect Dialect
+	Pattern string
+}
+
+// Match reports whether s matches the Matcher's pattern in its dialect.
+func (m Matcher) Match(s string) bool {
+	if m.Dialect == DialectMatrix {
+		re, err := compileMatrixGlob(m.Pattern)
+		check(err)
+		return re.MatchString(s)
+	}
+	return matchGlobPattern(m.Pattern, s)
+}
+
+// matrixGlobCache caches compiled Matrix-dialect patterns, keyed by pattern string.
+var matrixGlobCache sync.Map
+
+// hasGlobMatrix is a hasglob variant using the Matrix push-rule spec's glob
+// dialect: "*" matches any run of characters (including "/"), "?" matches
+// exactly one character, and there is no "**".
+func hasGlobMatrix(l []string, e string) bool {
+	for _, pattern := range l {
+		re, err := compileMatrixGlob(pattern)
 		check(err)
-		if g.Match(e) {
+		if re.MatchString(e) {
 			return true
 		}
 	}
 	return false
 }
 
+// compileMatrixGlob compiles a Matrix-dialect glob pattern into a regexp by
+// escaping regex metacharacters and replacing unescaped "*" with ".*" and
+// "?" with ".", anchoring the result with "^...$". Compiled regexps are
+// cached in matrixGlobCache, since the same pattern is typically matched
+// against many filenames.
+func compileMatrixGlob(pattern string) (*regexp.Regexp, error) {
+	if cached, ok := matrixGlobCache.Load(pattern); ok {
+		return cached.(*regexp.Regexp), nil
+	}
+
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, err
+	}
+	matrixGlobCache.Store(pattern, re)
+	return re, nil
+}
+
 // Given a map of string->bool and a string, figure out if the string is present as a key in the map
 func has(m map[string]bool, e string) bool {
 	if _, ok := m[e]; ok {
@@ -1222,13 +2450,23 @@ func hasb(m map[string][]byte, e string) bool {
 	return false
 }
 
+// cpioHeaderWriter is satisfied by both github.com/surma/gocpio's Writer
+// and archive.ReproducibleCPIOWriter, so ApplyMetadataToCpio/addFileToCPIO
+// can write a stable, sequentially-numbered inode stream under
+// --reproducible without changing how entries are written elsewhere.
+type cpioHeaderWriter interface {
+	WriteHeader(hdr *cpio.Header) error
+	Write(b []byte) (int, error)
+	Close() error
+}
+
 // ApplyMetadataToCpio takes a tar archive and a YAML metadata file. It then applies
 // all the metadata to the tar archive contents and outputs a new tar archive.
 // root == True will not set alle file permissions to root, only the undeclared ones.
-func ApplyMetadataToCpio(tarfilename, yamlfilename, newfilename string, force, withBody, root, verbose, skipEmptyFiles bool) error {
+func ApplyMetadataToCpio(tarfilename, yamlfilename, newfilename, rulesetPath string, force, withBody, root, verbose, skipEmptyFiles, overlayWhiteout bool, compress string, opts Options) error {
 
 	// Read the metadata
-	yamldata, err := ioutil.ReadFile(yamlfilename)
+	yamldata, err := readFile(opts, yamlfilename)
 	if err != nil {
 		return err
 	}
@@ -1246,6 +2484,12 @@ func ApplyMetadataToCpio(tarfilename, yamlfilename, newfilename string, force, w
 		}
 	}
 
+	if err := applyRuleset(rulesetPath, yamlfilename, verbose, &mfs); err != nil {
+		return err
+	}
+
+	applyWhiteouts(&mfs, overlayWhiteout)
+
 	// Store the files in the input archive in a map
 	bodymap := make(map[string][]byte)
 	// Store if files are copied over in this map
@@ -1259,16 +2503,20 @@ func ApplyMetadataToCpio(tarfilename, yamlfilename, newfilename string, force, w
 	// Store skipped files
 	skipmap := make(map[string]bool)
 
-	// Skip the input tar file if the filename is empty
+	// Skip the input tar file if the filename is empty. Otherwise, stream it
+	// in (auto-decompressing gzip/bzip2 on the fly) instead of reading the
+	// whole compressed file into memory first.
 	if tarfilename != "" {
-
-		// Read the input tarfile
-		dat, err := ioutil.ReadFile(tarfilename)
+		f, err := opts.FS.Open(tarfilename)
 		if err != nil {
 			return err
 		}
-		r := bytes.NewReader(dat)
-		tr := tar.NewReader(r)
+		defer f.Close()
+		dr, err := archive.Decompress(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", tarfilename, err)
+		}
+		tr := tar.NewReader(dr)
 
 		// Loop over all files in the input tar archive
 		for {
@@ -1290,14 +2538,40 @@ func ApplyMetadataToCpio(tarfilename, yamlfilename, newfilename string, force, w
 
 	}
 
-	// Create a buffer to write our new archive to.
-	buf := new(bytes.Buffer)
+	// Check if the CPIO file exists first
+	if !force && metafs.Exists(opts.FS, newfilename) {
+		quit(fmt.Sprintf("%s already exists", newfilename))
+	}
+	out, err := opts.FS.Create(newfilename)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if compress == "" {
+		compress = archive.DetectCompressionFromName(newfilename)
+	}
+	cwriter, err := archive.CompressWriter(out, compress)
+	if err != nil {
+		return fmt.Errorf("%s: %w", newfilename, err)
+	}
 
-	// Create a new tar archive.
-	cw := cpio.NewWriter(buf)
+	// Create a new cpio archive, writing straight to the (possibly
+	// compressed) output file instead of buffering it all in memory first.
+	// --reproducible swaps in a writer with a stable inode counter starting
+	// from 1, since gocpio's own Writer always starts at its hardcoded 721.
+	var cw cpioHeaderWriter
+	if opts.Reproducible {
+		cw = archive.NewReproducibleCPIOWriter(cwriter, 1)
+	} else {
+		cw = cpio.NewWriter(cwriter)
+	}
 
 	// Choose a timestamp (seconds since epoch)
 	mtime := time.Now().Unix()
+	if opts.Reproducible {
+		mtime = opts.SourceDateEpoch
+	}
 
 	// "Should skip" function
 	ssf := func(filename string) bool {
@@ -1305,7 +2579,11 @@ func ApplyMetadataToCpio(tarfilename, yamlfilename, newfilename string, force, w
 	}
 
 	// Loop through the files in the metadata and write the corresponding file to the tar
-	for _, mf := range mfs.Contents {
+	contents := mfs.Contents
+	if opts.Reproducible {
+		contents = sortedByFilename(contents)
+	}
+	for _, mf := range contents {
 		if ssf(mf.Filename) {
 			mf.Skip = true
 		}
@@ -1313,7 +2591,16 @@ func ApplyMetadataToCpio(tarfilename, yamlfilename, newfilename string, force, w
 	}
 
 	// List all files in bodymap but not in donemap (from the tar, but no YAML metadata)
+	bodymapFilenames := make([]string, 0, len(bodymap))
 	for filename := range bodymap {
+		bodymapFilenames = append(bodymapFilenames, filename)
+	}
+	if opts.Reproducible {
+		sort.Slice(bodymapFilenames, func(i, j int) bool {
+			return filepath.Clean(bodymapFilenames[i]) < filepath.Clean(bodymapFilenames[j])
+		})
+	}
+	for _, filename := range bodymapFilenames {
 		autocreatedDirectory := has(dirmap, filename) || has(dirmap, filepath.Clean(filename))
 		isDone := has(donemap, filename) || has(donemap, filepath.Clean(filename))
 		isRenamed := has(renmap, filename) || has(renmap, filepath.Clean(filename))
@@ -1356,29 +2643,23 @@ func ApplyMetadataToCpio(tarfilename, yamlfilename, newfilename string, force, w
 		}
 	}
 
-	// Check if the CPIO file exists first
-	if !force && exists(newfilename) {
-		quit(fmt.Sprintf("%s already exists", newfilename))
-	}
-
-	// Write the new CPIO file
-	return ioutil.WriteFile(newfilename, buf.Bytes(), 0644)
+	return cwriter.Close()
 }
 
 // MergeMetadata merges two YAML files. The first file contents are overridden by the second one.
 // The newfilename can be a new YAML filename or "-" for standard out.
-func MergeMetadata(yamlfilename1, yamlfilename2, newfilename string, force, verbose bool) error {
+func MergeMetadata(yamlfilename1, yamlfilename2, newfilename string, force, verbose bool, opts Options) error {
 
 	if verbose {
 		fmt.Printf("Merge %s and %s into %s, with force=%v and verbose=%v\n", yamlfilename1, yamlfilename2, newfilename, force, verbose)
 	}
 
 	// Read the metadata
-	yamldata1, err := ioutil.ReadFile(yamlfilename1)
+	yamldata1, err := readFile(opts, yamlfilename1)
 	if err != nil {
 		return err
 	}
-	yamldata2, err := ioutil.ReadFile(yamlfilename2)
+	yamldata2, err := readFile(opts, yamlfilename2)
 	if err != nil {
 		return err
 	}
@@ -1478,12 +2759,8 @@ UP:
 		// Write to stdout
 		fmt.Print(buf.String())
 	} else {
-		// Check if the YAML file exists first
-		if !force && exists(newfilename) {
-			quit(fmt.Sprintf("%s already exists", newfilename))
-		}
 		// Write the YAML file
-		if ioutil.WriteFile(newfilename, buf.Bytes(), 0644) != nil {
+		if err := writeFile(opts, newfilename, buf.Bytes(), force); err != nil {
 			return err
 		}
 	}
@@ -1491,29 +2768,1052 @@ UP:
 	return nil
 }
 
-func main() {
-	arguments, _ := docopt.Parse(usage, nil, true, fmt.Sprintf("%s %v", metatarName, metatarVersion), false)
+// tarEntry is one decoded entry from an old/new tar pair being compared by
+// DiffTars: the header plus, for regular files, the full body (needed to
+// tell a changed file from an unchanged one).
+type tarEntry struct {
+	hdr  *tar.Header
+	body []byte
+}
 
-	//fmt.Println(arguments)
+// readTarEntries reads every entry in tarfilename into an ordered name ->
+// tarEntry map, auto-decompressing the input the same way ApplyMetadataToTar
+// does. Whiteout/opaque markers are not expected in either side of a diff
+// and are read back as plain entries, same as any other file.
+func readTarEntries(tarfilename string) (map[string]tarEntry, []string, error) {
+	f, err := os.Open(tarfilename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
 
-	yamlfilename := ""
-	if !arguments["--list"].(bool) && !arguments["--yaml"].(bool) && !arguments["--merge"].(bool) && !arguments["--listcpio"].(bool) {
-		var ok bool
-		yamlfilename, ok = arguments["<yamlfile>"].(string)
-		if !ok && arguments["<yamlfile>"] == nil {
-			fmt.Println(usage)
-			os.Exit(1)
-		} else if ok && (strings.HasSuffix(".yml", yamlfilename) || strings.HasSuffix(".yaml", yamlfilename)) {
-			// Filename is a string, but with the wrong extension
-			quit(fmt.Sprintf("Invalid input YAML filename: %s", yamlfilename))
+	r, err := archive.Decompress(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", tarfilename, err)
+	}
+
+	entries := make(map[string]tarEntry)
+	var order []string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", tarfilename, err)
+		}
+		var body bytes.Buffer
+		if _, err := io.Copy(&body, tr); err != nil {
+			return nil, nil, err
 		}
+		name := filepath.Clean(hdr.Name)
+		entries[name] = tarEntry{hdr: hdr, body: body.Bytes()}
+		order = append(order, name)
 	}
+	return entries, order, nil
+}
 
-	yamlfilename1 := ""
-	yamlfilename2 := ""
-	if arguments["--merge"].(bool) {
-		var ok bool
-		yamlfilename1, ok = arguments["<yamlfile1>"].(string)
+// DiffTars compares oldtarfilename against newtarfilename and writes
+// patchyamlfilename: a Contents entry (with Body: base64) for every file
+// added or changed in newtarfilename, a Whiteout: true entry for every path
+// removed, and an OpaqueDir: true entry instead of per-file whiteouts for a
+// directory whose entire old contents were replaced wholesale. Applying the
+// resulting YAML with --apply against oldtarfilename reproduces
+// newtarfilename, the same way an OCI image layer is built from a diff
+// between two filesystem snapshots.
+func DiffTars(oldtarfilename, newtarfilename, patchyamlfilename string, force, verbose bool) error {
+	oldEntries, oldOrder, err := readTarEntries(oldtarfilename)
+	if err != nil {
+		return err
+	}
+	newEntries, newOrder, err := readTarEntries(newtarfilename)
+	if err != nil {
+		return err
+	}
+
+	// Directories present in both that were wholesale replaced: every old
+	// child is gone from the new tar, and at least one child exists there
+	// instead, so the directory is marked opaque rather than whiteout-ing
+	// each old child individually.
+	opaqueDirs := make(map[string]bool)
+	for _, name := range oldOrder {
+		if oldEntries[name].hdr.Typeflag != tar.TypeDir {
+			continue
+		}
+		newEntry, ok := newEntries[name]
+		if !ok || newEntry.hdr.Typeflag != tar.TypeDir {
+			continue
+		}
+		if !hasChild(newOrder, name) || !allChildrenGone(oldOrder, name, newEntries) {
+			continue
+		}
+		opaqueDirs[name] = true
+		if verbose {
+			fmt.Printf("%s: %s replaced wholesale, marking opaque\n", filepath.Base(patchyamlfilename), name)
+		}
+	}
+
+	mfs := MetaArchiveRegular{Version: metatarVersion}
+
+	// Removed paths: present in old, gone in new. Skip anything beneath an
+	// opaque or already-whiteout-ed ancestor, since a whiteout (or opaque
+	// marker) on a directory already accounts for everything beneath it.
+	removed := make(map[string]bool)
+	for _, name := range oldOrder {
+		if _, ok := newEntries[name]; ok {
+			continue
+		}
+		if hasMarkedAncestor(removed, opaqueDirs, name) {
+			continue
+		}
+		removed[name] = true
+		if verbose {
+			fmt.Printf("%s: removed %s\n", filepath.Base(patchyamlfilename), name)
+		}
+		mfs.Contents = append(mfs.Contents, MetaFileRegular{Filename: name, Type: "regular file", Whiteout: true})
+	}
+
+	for name := range opaqueDirs {
+		m := tar2metadata(newEntries[name].hdr, false)
+		m.Filename = name
+		m.OpaqueDir = true
+		mfs.Contents = append(mfs.Contents, MetaFileRegular(m))
+	}
+
+	// Added or changed files: present in new, either missing from old or
+	// with different metadata/content. A file under an opaque directory is
+	// "added" even if an old file of the same name and content happened to
+	// exist elsewhere, since the opaque marker hides the old tree first.
+	for _, name := range newOrder {
+		newEntry := newEntries[name]
+		oldEntry, existed := oldEntries[name]
+		if existed && !hasMarkedAncestor(nil, opaqueDirs, name) && sameEntry(oldEntry, newEntry) {
+			continue
+		}
+		m := tar2metadata(newEntry.hdr, false)
+		m.Filename = name
+		if newEntry.hdr.Typeflag == tar.TypeReg || newEntry.hdr.Typeflag == tar.TypeRegA {
+			m.Digest = contentDigest(newEntry.body)
+		}
+		m.BodySize = len(newEntry.body)
+		m.Body = base64.StdEncoding.EncodeToString(newEntry.body)
+		if verbose {
+			verb := "added"
+			if existed {
+				verb = "changed"
+			}
+			fmt.Printf("%s: %s %s\n", filepath.Base(patchyamlfilename), verb, name)
+		}
+		mfs.Contents = append(mfs.Contents, MetaFileRegular(m))
+	}
+
+	mfs.RootDigest = computeRootDigest(mfs.Contents)
+
+	yamldata, err := yaml.Marshal(&mfs)
+	if err != nil {
+		return err
+	}
+
+	if patchyamlfilename == "-" {
+		fmt.Print(string(yamldata))
+		return nil
+	}
+	if !force && exists(patchyamlfilename) {
+		quit(fmt.Sprintf("%s already exists", patchyamlfilename))
+	}
+	return ioutil.WriteFile(patchyamlfilename, yamldata, 0644)
+}
+
+// hasMarkedAncestor reports whether any parent directory of name is already
+// marked removed or opaque. Either map may be nil.
+func hasMarkedAncestor(removed, opaqueDirs map[string]bool, name string) bool {
+	for dir := filepath.Dir(name); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		if removed[dir] || opaqueDirs[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// hasChild reports whether any entry in order is a direct or indirect child
+// of dir.
+func hasChild(order []string, dir string) bool {
+	prefix := dir + string(filepath.Separator)
+	for _, name := range order {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// allChildrenGone reports whether every child of dir in order (the old
+// tar's listing) is absent from newEntries, i.e. none of dir's old contents
+// survived into the new tar under the same path.
+func allChildrenGone(order []string, dir string, newEntries map[string]tarEntry) bool {
+	prefix := dir + string(filepath.Separator)
+	found := false
+	for _, name := range order {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		found = true
+		if _, ok := newEntries[name]; ok {
+			return false
+		}
+	}
+	return found
+}
+
+// sameEntry reports whether two tar entries for the same path are
+// equivalent enough to skip from a diff: same type, mode, ownership, link
+// target and content.
+func sameEntry(a, b tarEntry) bool {
+	if a.hdr.Typeflag != b.hdr.Typeflag || a.hdr.Mode != b.hdr.Mode {
+		return false
+	}
+	if a.hdr.Uid != b.hdr.Uid || a.hdr.Gid != b.hdr.Gid {
+		return false
+	}
+	if a.hdr.Linkname != b.hdr.Linkname {
+		return false
+	}
+	return bytes.Equal(a.body, b.body)
+}
+
+// applyRuleset loads the ruleset at rulesetPath (if any) and applies it to
+// mfs.Contents in place, dropping entries the ruleset excludes.
+func applyRuleset(rulesetPath, yamlfilename string, verbose bool, mfs *MetaArchiveRegular) error {
+	rs, err := LoadRuleset(rulesetPath)
+	if err != nil {
+		return err
+	}
+	if len(rs.Rules) == 0 {
+		return nil
+	}
+
+	kept := mfs.Contents[:0]
+	for i := range mfs.Contents {
+		out, keep := rs.Apply(&mfs.Contents[i])
+		if !keep {
+			if verbose {
+				fmt.Printf("%s: ruleset excludes %s\n", filepath.Base(yamlfilename), mfs.Contents[i].Filename)
+			}
+			continue
+		}
+		kept = append(kept, *out)
+	}
+	mfs.Contents = kept
+
+	return nil
+}
+
+// applyWhiteouts rewrites any Whiteout/OpaqueDir entries in mfs.Contents into
+// their on-disk tar representation: AUFS-style ".wh.<name>" marker files and
+// ".wh..wh..opq" opaque-directory marker files by default, or (with overlay
+// set, for --whiteout=overlay) OverlayFS-style character devices with
+// major=0/minor=0 and a "trusted.overlay.opaque=y" xattr on the directory.
+func applyWhiteouts(mfs *MetaArchiveRegular, overlay bool) {
+	var extra []MetaFileRegular
+	for i := range mfs.Contents {
+		mf := &mfs.Contents[i]
+		if mf.OpaqueDir {
+			if overlay {
+				mf.Xattrs = append(mf.Xattrs, Xattr{Key: "trusted.overlay.opaque", Value: "y"})
+			} else {
+				// Whiteout stays true on the marker file itself: it's an
+				// intentionally empty file, so it must survive the
+				// default --noskip-empty-files behavior below.
+				extra = append(extra, MetaFileRegular{
+					Filename: filepath.Join(mf.Filename, whiteoutOpaqueMarker),
+					Type:     "regular file",
+					UID:      mf.UID,
+					GID:      mf.GID,
+					Whiteout: true,
+				})
+			}
+			mf.OpaqueDir = false
+		}
+		if mf.Whiteout {
+			if overlay {
+				mf.Type = "character device node"
+				mf.Devmajor, mf.Devminor = 0, 0
+				mf.BodySize, mf.Body = 0, ""
+				mf.Whiteout = false
+			} else {
+				dir, base := filepath.Split(mf.Filename)
+				mf.Filename = filepath.Join(dir, whiteoutPrefix+base)
+				mf.Type = "regular file"
+				mf.BodySize, mf.Body = 0, ""
+				// Keep Whiteout true so the empty AUFS marker file below
+				// isn't dropped by the default empty-file skip.
+			}
+		}
+	}
+	mfs.Contents = append(mfs.Contents, extra...)
+}
+
+// writeRawstreamSidecar disassembles tardata with tarsplit and gob-encodes
+// the result to "<yamlfilename>.rawstream", so that a later --apply
+// --rawstream can reassemble the tar byte-for-byte.
+func writeRawstreamSidecar(tardata []byte, yamlfilename string, verbose bool) error {
+	stream, err := tarsplit.Disassemble(bytes.NewReader(tardata))
+	if err != nil {
+		return err
+	}
+
+	sidecarPath := yamlfilename + ".rawstream"
+	f, err := os.Create(sidecarPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := gob.NewEncoder(f).Encode(stream); err != nil {
+		return err
+	}
+	if verbose {
+		fmt.Printf("wrote raw tar-split sidecar: %s\n", sidecarPath)
+	}
+	return nil
+}
+
+// applyRawstream reassembles newfilename byte-for-byte using the tarsplit
+// sidecar written by --save --rawstream, substituting any body that the
+// YAML overrides (as long as the replacement is the same length as the
+// original, since a tar header's Size field can't be rewritten in place).
+// This mode is mutually exclusive with Skip/Rename/Strip*, which change the
+// tar's shape.
+func applyRawstream(yamlfilename, newfilename string, force bool, mfs *MetaArchiveRegular) error {
+	sidecarPath := yamlfilename + ".rawstream"
+	sidecar, err := os.Open(sidecarPath)
+	if err != nil {
+		return fmt.Errorf("--rawstream: %w (run --save --rawstream first)", err)
+	}
+	defer sidecar.Close()
+
+	var stream tarsplit.Stream
+	if err := gob.NewDecoder(sidecar).Decode(&stream); err != nil {
+		return fmt.Errorf("--rawstream: decoding %s: %w", sidecarPath, err)
+	}
+
+	bodymap := make(map[string][]byte)
+	for _, mf := range mfs.Contents {
+		if mf.Body == "" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(mf.Body)
+		if err != nil {
+			return fmt.Errorf("--rawstream: decoding body for %s: %w", mf.Filename, err)
+		}
+		bodymap[mf.Filename] = b
+	}
+
+	if !force && exists(newfilename) {
+		quit(fmt.Sprintf("%s already exists", newfilename))
+	}
+	out, err := os.Create(newfilename)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	return stream.Assemble(out, bodymap)
+}
+
+// Rule is one step of a Ruleset: a glob pattern together with the
+// transformation to apply to entries whose filename matches it at the time
+// the rule is reached (rules run in order, so a rename earlier in the list
+// changes what a later pattern matches against).
+type Rule struct {
+	Pattern     string `yaml:"pattern"`
+	Include     bool   `yaml:"include,omitempty"`
+	Exclude     bool   `yaml:"exclude,omitempty"`
+	Rename      string `yaml:"rename,omitempty"` // e.g. "{{.}}.bak", with "{{.}}" bound to the text the pattern's "*" captured
+	Chmod       string `yaml:"chmod,omitempty"`  // octal mode, e.g. "0644"
+	Chown       string `yaml:"chown,omitempty"`  // "uid:gid"
+	StripPrefix string `yaml:"strip-prefix,omitempty"`
+	AddPrefix   string `yaml:"add-prefix,omitempty"`
+	SetMtime    int64  `yaml:"set-mtime,omitempty"` // seconds since epoch
+}
+
+// Ruleset is an ordered pipeline of rules loaded from a YAML rules file
+// (`--rules rules.yaml`), applied to every entry of an archive's metadata.
+type Ruleset struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Apply runs every rule whose pattern matches mf's (possibly already
+// renamed, by an earlier rule) filename, in order, and returns the resulting
+// entry together with whether it should be kept. mf.Filename is left as-is,
+// since ApplyMetadataToTar/ApplyMetadataToCpio use it as the lookup key into
+// the input archive's file bodies; a rename ends up in the returned entry's
+// Rename field instead, exactly like a hand-written "Rename:" in the YAML.
+func (rs *Ruleset) Apply(mf *MetaFileRegular) (*MetaFileRegular, bool) {
+	out := *mf
+	name := mf.Filename
+	keep := true
+
+	for _, r := range rs.Rules {
+		if !matchGlobPattern(r.Pattern, name) {
+			continue
+		}
+
+		if r.Include {
+			keep = true
+		}
+		if r.Exclude {
+			keep = false
+		}
+		if r.Rename != "" {
+			name = expandRenameTemplate(r.Pattern, r.Rename, name)
+		}
+		if r.StripPrefix != "" {
+			name = strings.TrimPrefix(name, r.StripPrefix)
+		}
+		if r.AddPrefix != "" {
+			name = r.AddPrefix + name
+		}
+		if r.Chmod != "" {
+			mode, err := strconv.ParseInt(r.Chmod, 8, 64)
+			if err != nil {
+				quit(fmt.Sprintf("rule for %q: invalid chmod %q: %s", r.Pattern, r.Chmod, err.Error()))
+			}
+			out.Mode = yaml.Octal(mode)
+		}
+		if r.Chown != "" {
+			uid, gid, err := parseChown(r.Chown)
+			if err != nil {
+				quit(fmt.Sprintf("rule for %q: invalid chown %q: %s", r.Pattern, r.Chown, err.Error()))
+			}
+			out.UID, out.GID = uid, gid
+		}
+		if r.SetMtime != 0 {
+			out.Mtime = r.SetMtime
+		}
+	}
+
+	if name != mf.Filename {
+		out.Rename = name
+	}
+
+	return &out, keep
+}
+
+// expandRenameTemplate expands "{{.}}" in template to the text that the
+// single "*" in pattern captured out of filename. If pattern has no "*" or
+// template has no "{{.}}", template is used verbatim.
+func expandRenameTemplate(pattern, template, filename string) string {
+	idx := strings.Index(pattern, "*")
+	if idx < 0 || !strings.Contains(template, "{{.}}") {
+		return template
+	}
+	prefix, suffix := pattern[:idx], pattern[idx+1:]
+	if !strings.HasPrefix(filename, prefix) || !strings.HasSuffix(filename, suffix) {
+		return template
+	}
+	captured := filename[len(prefix) : len(filename)-len(suffix)]
+	return strings.ReplaceAll(template, "{{.}}", captured)
+}
+
+// parseChown parses a "uid:gid" string, as used by the Chown field of Rule.
+func parseChown(s string) (uid, gid int, err error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, errors.New("expected \"uid:gid\"")
+	}
+	uid, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	gid, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
+
+// LoadRuleset reads a YAML rules file and parses it into a Ruleset. If path
+// is empty, a ".metatar.yaml" is looked for in the current directory, then
+// under the XDG config locations ($XDG_CONFIG_HOME/metatar, or
+// ~/.config/metatar), the way many Go CLIs resolve configuration files. If no
+// rules file is found this way, an empty Ruleset is returned (nothing is
+// skipped or changed). Validation errors are annotated with the 1-indexed
+// rule number and, where found, the source line of its "pattern:" key.
+func LoadRuleset(path string) (*Ruleset, error) {
+	if path == "" {
+		path = discoverRulesFile()
+		if path == "" {
+			return &Ruleset{}, nil
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rs Ruleset
+	if err := yaml.Unmarshal(data, &rs); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	for i, r := range rs.Rules {
+		if r.Pattern == "" {
+			if line := findRuleLine(data, i); line > 0 {
+				return nil, fmt.Errorf("%s:%d: rule %d is missing \"pattern\"", path, line, i+1)
+			}
+			return nil, fmt.Errorf("%s: rule %d is missing \"pattern\"", path, i+1)
+		}
+		if _, err := glob.Compile(r.Pattern); err != nil {
+			return nil, fmt.Errorf("%s: rule %d: invalid pattern %q: %s", path, i+1, r.Pattern, err.Error())
+		}
+	}
+
+	return &rs, nil
+}
+
+// findRuleLine returns the 1-indexed source line of the start of the
+// ruleIndex'th "- " list item in data, or 0 if it can't be found.
+func findRuleLine(data []byte, ruleIndex int) int {
+	seen := 0
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "- ") {
+			if seen == ruleIndex {
+				return i + 1
+			}
+			seen++
+		}
+	}
+	return 0
+}
+
+// discoverRulesFile looks for a rules file when none was given explicitly on
+// the command line, checking "./.metatar.yaml" first and then the XDG config
+// locations for "metatar/rules.yaml".
+func discoverRulesFile() string {
+	candidates := []string{".metatar.yaml"}
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		candidates = append(candidates, filepath.Join(xdg, "metatar", "rules.yaml"))
+	} else if home, err := os.UserHomeDir(); err == nil {
+		candidates = append(candidates, filepath.Join(home, ".config", "metatar", "rules.yaml"))
+	}
+	for _, c := range candidates {
+		if exists(c) {
+			return c
+		}
+	}
+	return ""
+}
+
+// TransformSpec is one step of a MetaFile's Transforms pipeline: a
+// registered Transformer's name plus its arguments, run in order on the
+// file's body (and, for transforms like rebase-path or chmod, its header)
+// right before it's written to the output archive.
+type TransformSpec struct {
+	Name string            `yaml:"name"`
+	Args map[string]string `yaml:"args,omitempty"`
+}
+
+// Transformer rewrites a single tar entry's body, and may mutate its header
+// (e.g. Name for a rename, Mode for a chmod) along the way.
+type Transformer interface {
+	Name() string
+	Apply(hdr *tar.Header, body []byte) ([]byte, error)
+}
+
+// TransformFactory builds a Transformer configured with a TransformSpec's
+// args, as registered under a name with RegisterTransform.
+type TransformFactory func(args map[string]string) (Transformer, error)
+
+var (
+	transformRegistryMu sync.RWMutex
+	transformRegistry   = map[string]TransformFactory{}
+)
+
+// RegisterTransform makes a transform available by name in a file's
+// "Transforms:" pipeline. Registering a name that is already present
+// replaces it, so callers can override a built-in from their own Go code.
+func RegisterTransform(name string, factory TransformFactory) {
+	transformRegistryMu.Lock()
+	defer transformRegistryMu.Unlock()
+	transformRegistry[name] = factory
+}
+
+// newTransform looks up spec.Name in the registry and builds a Transformer
+// configured with spec.Args.
+func newTransform(spec TransformSpec) (Transformer, error) {
+	transformRegistryMu.RLock()
+	factory, ok := transformRegistry[spec.Name]
+	transformRegistryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown transform %q", spec.Name)
+	}
+	return factory(spec.Args)
+}
+
+// applyTransforms runs body through every step of specs in order, against
+// hdr (which a step such as rebase-path or chmod may also mutate).
+func applyTransforms(hdr *tar.Header, body []byte, specs []TransformSpec) ([]byte, error) {
+	for _, spec := range specs {
+		t, err := newTransform(spec)
+		if err != nil {
+			return nil, fmt.Errorf("transform %q: %w", spec.Name, err)
+		}
+		body, err = t.Apply(hdr, body)
+		if err != nil {
+			return nil, fmt.Errorf("transform %q: %w", spec.Name, err)
+		}
+	}
+	return body, nil
+}
+
+func init() {
+	RegisterTransform("strip-empty-lines", newStripEmptyLinesTransform)
+	RegisterTransform("strip-comments", newStripCommentsTransform)
+	RegisterTransform("gzip", newGzipTransform)
+	RegisterTransform("gunzip", newGunzipTransform)
+	RegisterTransform("sed", newSedTransform)
+	RegisterTransform("template", newTemplateTransform)
+	RegisterTransform("chmod", newChmodTransform)
+	RegisterTransform("rebase-path", newRebasePathTransform)
+	RegisterTransform("patch", newPatchTransform)
+}
+
+// stripEmptyLinesTransform collapses runs of consecutive blank lines down to
+// a single newline, the same rewrite previously hardcoded behind the
+// "StripEmptyLines: true" field.
+type stripEmptyLinesTransform struct{}
+
+func newStripEmptyLinesTransform(map[string]string) (Transformer, error) {
+	return stripEmptyLinesTransform{}, nil
+}
+
+func (stripEmptyLinesTransform) Name() string { return "strip-empty-lines" }
+
+func (stripEmptyLinesTransform) Apply(hdr *tar.Header, body []byte) ([]byte, error) {
+	re, err := regexp.Compile("\n\n")
+	if err != nil {
+		return nil, err
+	}
+	return []byte(re.ReplaceAllString(string(body), "\n")), nil
+}
+
+// stripCommentsTransform removes lines beginning with "#", keeping a leading
+// "#!" shebang line, the same rewrite previously hardcoded behind the
+// "StripComments: true" field.
+type stripCommentsTransform struct{}
+
+func newStripCommentsTransform(map[string]string) (Transformer, error) {
+	return stripCommentsTransform{}, nil
+}
+
+func (stripCommentsTransform) Name() string { return "strip-comments" }
+
+func (stripCommentsTransform) Apply(hdr *tar.Header, body []byte) ([]byte, error) {
+	var l []string
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, "#!") {
+			l = append(l, line)
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		l = append(l, line)
+	}
+	return []byte(strings.Join(l, "\n")), nil
+}
+
+// gzipTransform gzip-compresses the body, e.g. to store a smaller blob in
+// the YAML or re-derive a ".gz" sibling via rebase-path.
+type gzipTransform struct{}
+
+func newGzipTransform(map[string]string) (Transformer, error) {
+	return gzipTransform{}, nil
+}
+
+func (gzipTransform) Name() string { return "gzip" }
+
+func (gzipTransform) Apply(hdr *tar.Header, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gunzipTransform is gzipTransform's inverse.
+type gunzipTransform struct{}
+
+func newGunzipTransform(map[string]string) (Transformer, error) {
+	return gunzipTransform{}, nil
+}
+
+func (gunzipTransform) Name() string { return "gunzip" }
+
+func (gunzipTransform) Apply(hdr *tar.Header, body []byte) ([]byte, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+	return io.ReadAll(gr)
+}
+
+// sedTransform does a regex find-and-replace over the body, taking its
+// pattern and replacement from args["pattern"] and args["replacement"]
+// (Go regexp.ReplaceAll syntax, so "$1" refers to a capture group).
+type sedTransform struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+func newSedTransform(args map[string]string) (Transformer, error) {
+	pattern, ok := args["pattern"]
+	if !ok {
+		return nil, errors.New(`requires args["pattern"]`)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	return sedTransform{pattern: re, replacement: args["replacement"]}, nil
+}
+
+func (sedTransform) Name() string { return "sed" }
+
+func (t sedTransform) Apply(hdr *tar.Header, body []byte) ([]byte, error) {
+	return t.pattern.ReplaceAll(body, []byte(t.replacement)), nil
+}
+
+// templateTransform parses the body as a Go text/template and executes it
+// against args, so a file can be a template with its values supplied
+// per-entry via "Transforms: [{name: template, args: {...}}]".
+type templateTransform struct {
+	values map[string]string
+}
+
+func newTemplateTransform(args map[string]string) (Transformer, error) {
+	return templateTransform{values: args}, nil
+}
+
+func (templateTransform) Name() string { return "template" }
+
+func (t templateTransform) Apply(hdr *tar.Header, body []byte) ([]byte, error) {
+	tmpl, err := template.New(hdr.Name).Parse(string(body))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, t.values); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// chmodTransform sets the entry's mode from args["mode"] (an octal string,
+// e.g. "0755"). For rewriting a whole subtree at once, see Rule.Chmod in a
+// --rules ruleset instead; this transform only ever touches its own entry.
+type chmodTransform struct {
+	mode int64
+}
+
+func newChmodTransform(args map[string]string) (Transformer, error) {
+	modeStr, ok := args["mode"]
+	if !ok {
+		return nil, errors.New(`requires args["mode"]`)
+	}
+	mode, err := strconv.ParseInt(modeStr, 8, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mode %q: %w", modeStr, err)
+	}
+	return chmodTransform{mode: mode}, nil
+}
+
+func (chmodTransform) Name() string { return "chmod" }
+
+func (t chmodTransform) Apply(hdr *tar.Header, body []byte) ([]byte, error) {
+	hdr.Mode = t.mode
+	return body, nil
+}
+
+// rebasePathTransform replaces a leading path prefix on the entry's name,
+// analogous to Docker's archive.TarOptions.RebaseNames. args["old"] is the
+// prefix to strip, args["new"] is what replaces it.
+type rebasePathTransform struct {
+	old, new string
+}
+
+func newRebasePathTransform(args map[string]string) (Transformer, error) {
+	old, ok := args["old"]
+	if !ok {
+		return nil, errors.New(`requires args["old"]`)
+	}
+	return rebasePathTransform{old: old, new: args["new"]}, nil
+}
+
+func (rebasePathTransform) Name() string { return "rebase-path" }
+
+func (t rebasePathTransform) Apply(hdr *tar.Header, body []byte) ([]byte, error) {
+	if strings.HasPrefix(hdr.Name, t.old) {
+		hdr.Name = t.new + strings.TrimPrefix(hdr.Name, t.old)
+	}
+	return body, nil
+}
+
+// patchTransform applies a unified diff (as produced by "diff -u" or "git
+// diff") to the body, taken from args["diff"]. Hunks are applied strictly:
+// a context or removed line that doesn't match the body's current content
+// at that position is an error, rather than a best-effort fuzzy match.
+type patchTransform struct {
+	hunks []diffHunk
+}
+
+func newPatchTransform(args map[string]string) (Transformer, error) {
+	diff, ok := args["diff"]
+	if !ok {
+		return nil, errors.New(`requires args["diff"]`)
+	}
+	hunks, err := parseUnifiedDiffHunks(diff)
+	if err != nil {
+		return nil, err
+	}
+	return patchTransform{hunks: hunks}, nil
+}
+
+func (patchTransform) Name() string { return "patch" }
+
+func (t patchTransform) Apply(hdr *tar.Header, body []byte) ([]byte, error) {
+	trailingNewline := bytes.HasSuffix(body, []byte("\n"))
+	lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+
+	// delta tracks how many lines earlier hunks have net added (or removed)
+	// so far, since each hunk's origStart is a line number in the *original*
+	// document but is applied against lines that prior hunks have already
+	// mutated in place.
+	var err error
+	delta := 0
+	for _, h := range t.hunks {
+		before := len(lines)
+		lines, err = h.apply(lines, delta)
+		if err != nil {
+			return nil, err
+		}
+		delta += len(lines) - before
+	}
+
+	out := strings.Join(lines, "\n")
+	if trailingNewline {
+		out += "\n"
+	}
+	return []byte(out), nil
+}
+
+// diffHunk is one "@@ -l,s +l,s @@" section of a unified diff: the 1-indexed
+// line in the original file where it starts, and its context/removed/added
+// lines in order.
+type diffHunk struct {
+	origStart int
+	lines     []diffLine
+}
+
+// diffLine is one line of a diffHunk: kind is ' ' (context), '-' (removed)
+// or '+' (added), as in unified diff syntax.
+type diffLine struct {
+	kind byte
+	text string
+}
+
+var unifiedDiffHunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,\d+)? \+\d+(?:,\d+)? @@`)
+
+// parseUnifiedDiffHunks parses the hunks out of a unified diff, ignoring any
+// "---"/"+++" file headers and "\ No newline at end of file" markers.
+func parseUnifiedDiffHunks(diff string) ([]diffHunk, error) {
+	var hunks []diffHunk
+	var cur *diffHunk
+	for _, line := range strings.Split(diff, "\n") {
+		if strings.HasPrefix(line, "@@ ") {
+			m := unifiedDiffHunkHeader.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("invalid hunk header: %q", line)
+			}
+			if cur != nil {
+				hunks = append(hunks, *cur)
+			}
+			start, _ := strconv.Atoi(m[1])
+			cur = &diffHunk{origStart: start}
+			continue
+		}
+		if cur == nil || line == "" {
+			continue
+		}
+		switch line[0] {
+		case ' ', '-', '+':
+			cur.lines = append(cur.lines, diffLine{kind: line[0], text: line[1:]})
+		case '\\':
+			// "\ No newline at end of file": nothing to track.
+		default:
+			return nil, fmt.Errorf("invalid diff line: %q", line)
+		}
+	}
+	if cur != nil {
+		hunks = append(hunks, *cur)
+	}
+	return hunks, nil
+}
+
+// apply applies one hunk to lines, returning the rewritten lines. delta is
+// the net number of lines earlier hunks in the same patch have already
+// added or removed, so h.origStart (a line number in the original document)
+// lands at the right place in lines (which reflects those earlier edits).
+func (h diffHunk) apply(lines []string, delta int) ([]string, error) {
+	pos := h.origStart - 1 + delta
+	if pos < 0 || pos > len(lines) {
+		return nil, fmt.Errorf("hunk starting at line %d is out of range", h.origStart)
+	}
+	out := append([]string{}, lines[:pos]...)
+	i := pos
+	for _, dl := range h.lines {
+		switch dl.kind {
+		case ' ', '-':
+			if i >= len(lines) || lines[i] != dl.text {
+				got := "<EOF>"
+				if i < len(lines) {
+					got = lines[i]
+				}
+				return nil, fmt.Errorf("context mismatch at line %d: got %q, want %q", i+1, got, dl.text)
+			}
+			if dl.kind == ' ' {
+				out = append(out, dl.text)
+			}
+			i++
+		case '+':
+			out = append(out, dl.text)
+		}
+	}
+	return append(out, lines[i:]...), nil
+}
+
+// orderedSelectorPatterns reconstructs --include/--exclude patterns in the
+// exact order they were given on the command line. docopt-go parses each
+// repeated option into its own slice (includes, excludes) and loses the
+// relative order between different option names, so this walks the raw
+// arguments to recover that order, while taking the pattern values
+// themselves from the already-decoded slices, which docopt-go has parsed
+// correctly regardless of whether "--include=X" or "--include X" form was
+// used. "--exclude=X" becomes the Selector pattern "X"; "--include=X"
+// becomes "!X", so that an --include occurring after a broader --exclude
+// re-includes what it covers, gitignore-style.
+func orderedSelectorPatterns(args []string, includes, excludes []string) []string {
+	var patterns []string
+	inclIdx, exclIdx := 0, 0
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case strings.HasPrefix(a, "--include="):
+			if inclIdx < len(includes) {
+				patterns = append(patterns, "!"+includes[inclIdx])
+				inclIdx++
+			}
+		case a == "--include":
+			if inclIdx < len(includes) {
+				patterns = append(patterns, "!"+includes[inclIdx])
+				inclIdx++
+			}
+			i++ // skip the separate value token
+		case strings.HasPrefix(a, "--exclude="):
+			if exclIdx < len(excludes) {
+				patterns = append(patterns, excludes[exclIdx])
+				exclIdx++
+			}
+		case a == "--exclude":
+			if exclIdx < len(excludes) {
+				patterns = append(patterns, excludes[exclIdx])
+				exclIdx++
+			}
+			i++ // skip the separate value token
+		}
+	}
+	return patterns
+}
+
+// ConvertFile converts an archive from one format (tar or cpio/newc) to the
+// other. The source format is taken from formatFlag ("tar", "cpio" or
+// "auto"), falling back to sniffing the magic bytes when it is "auto".
+// Entries matching any of the skip patterns (hasl/hasglob semantics) are
+// left out; selector, if non-nil, additionally filters entries using
+// ordered --include/--exclude rules.
+func ConvertFile(infilename, outfilename string, force, verbose bool, formatFlag string, skip []string, selector *Selector) error {
+	srcFormat, err := archive.ParseFormat(formatFlag)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(infilename)
+	if err != nil {
+		return err
+	}
+
+	detected := srcFormat
+	if detected == archive.FormatAuto {
+		detected = archive.DetectFormat(data)
+	}
+	dstFormat := archive.FormatCPIO
+	if detected == archive.FormatCPIO {
+		dstFormat = archive.FormatTar
+	}
+
+	keep := func(name string) bool {
+		if hasl(skip, name) || hasglob(skip, name) {
+			return false
+		}
+		return selector == nil || selector.Matches(name)
+	}
+
+	var buf bytes.Buffer
+	if err := archive.Convert(data, srcFormat, &buf, dstFormat, keep); err != nil {
+		return err
+	}
+
+	if verbose {
+		fmt.Printf("%s: converted to %s\n", infilename, outfilename)
+	}
+
+	if !force && exists(outfilename) {
+		quit(fmt.Sprintf("%s already exists", outfilename))
+	}
+	return ioutil.WriteFile(outfilename, buf.Bytes(), 0644)
+}
+
+func main() {
+	arguments, _ := docopt.Parse(usage, nil, true, fmt.Sprintf("%s %v", metatarName, metatarVersion), false)
+
+	//fmt.Println(arguments)
+
+	yamlfilename := ""
+	if !arguments["--list"].(bool) && !arguments["--yaml"].(bool) && !arguments["--merge"].(bool) && !arguments["--listcpio"].(bool) && !arguments["--convert"].(bool) && !arguments["--oci"].(bool) && !arguments["--diff"].(bool) {
+		var ok bool
+		yamlfilename, ok = arguments["<yamlfile>"].(string)
+		if !ok && arguments["<yamlfile>"] == nil {
+			fmt.Println(usage)
+			os.Exit(1)
+		} else if ok && (strings.HasSuffix(".yml", yamlfilename) || strings.HasSuffix(".yaml", yamlfilename)) {
+			// Filename is a string, but with the wrong extension
+			quit(fmt.Sprintf("Invalid input YAML filename: %s", yamlfilename))
+		}
+	}
+
+	yamlfilename1 := ""
+	yamlfilename2 := ""
+	if arguments["--merge"].(bool) {
+		var ok bool
+		yamlfilename1, ok = arguments["<yamlfile1>"].(string)
 		if !ok && arguments["<yamlfile1>"] == nil {
 			fmt.Println(usage)
 			os.Exit(1)
@@ -1532,7 +3832,7 @@ func main() {
 	}
 
 	tarfilename := ""
-	if !arguments["--generate"].(bool) && !arguments["--merge"].(bool) && !arguments["--listcpio"].(bool) {
+	if !arguments["--generate"].(bool) && !arguments["--merge"].(bool) && !arguments["--listcpio"].(bool) && !arguments["--oci"].(bool) && !arguments["--diff"].(bool) {
 		var ok bool
 		tarfilename, ok = arguments["<tarfile>"].(string)
 		if !ok && arguments["<tarfile>"] == nil {
@@ -1556,7 +3856,7 @@ func main() {
 	}
 
 	newfilename := ""
-	if arguments["--apply"].(bool) || arguments["--generate"].(bool) || arguments["--merge"].(bool) {
+	if arguments["--apply"].(bool) || arguments["--generate"].(bool) || arguments["--merge"].(bool) || arguments["--convert"].(bool) {
 		var ok bool
 		newfilename, ok = arguments["<newfile>"].(string)
 		if !ok && arguments["<newfile>"] == nil {
@@ -1567,6 +3867,37 @@ func main() {
 		}
 	}
 
+	layeryamlfilenames := []string{}
+	outputdir := ""
+	if arguments["--oci"].(bool) {
+		layeryamlfilenames, _ = arguments["<layeryaml>"].([]string)
+		outputdir, _ = arguments["<outputdir>"].(string)
+		if len(layeryamlfilenames) == 0 || outputdir == "" {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+	}
+
+	oldtarfilename, newtarfilename, patchyamlfilename := "", "", ""
+	if arguments["--diff"].(bool) {
+		var ok bool
+		oldtarfilename, ok = arguments["<oldtarfile>"].(string)
+		if !ok {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+		newtarfilename, ok = arguments["<newtarfile>"].(string)
+		if !ok {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+		patchyamlfilename, ok = arguments["<patchyaml>"].(string)
+		if !ok {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+	}
+
 	force := arguments["--force"].(bool)
 	verbose := arguments["--verbose"].(bool)
 	withBody := arguments["--data"].(bool)
@@ -1575,14 +3906,73 @@ func main() {
 	writeCPIO := arguments["--cpio"].(bool)
 	nouser := arguments["--nouser"].(bool)
 	skipEmptyFiles := !arguments["--noskip"].(bool)
+	format, _ := arguments["--format"].(string)
+	rulesetPath, _ := arguments["--rules"].(string)
+	rawstream, _ := arguments["--rawstream"].(bool)
+	extractBodiesDir, _ := arguments["--extract-bodies"].(string)
+	whiteoutStyle, _ := arguments["--whiteout"].(string)
+	overlayWhiteout := whiteoutStyle == "overlay"
+	compress, _ := arguments["--compress"].(string)
+	var skipPatterns []string
+	if patterns, ok := arguments["--skip"].([]string); ok {
+		skipPatterns = patterns
+	}
+	var includePatterns, excludePatterns []string
+	if patterns, ok := arguments["--include"].([]string); ok {
+		includePatterns = patterns
+	}
+	if patterns, ok := arguments["--exclude"].([]string); ok {
+		excludePatterns = patterns
+	}
+
+	// opts carries the metafs backend for this invocation. --input-url
+	// overrides the file that's read (<tarfile>, or <yamlfile> under
+	// --generate, or <yamlfile1> under --merge); --output-url overrides
+	// the file that's written (<yamlfile> under --save, or <newfile>
+	// otherwise). If both name a backend, --output-url's wins for the
+	// whole call, since Options only carries a single FS.
+	opts := DefaultOptions()
+	if inputURL, _ := arguments["--input-url"].(string); inputURL != "" {
+		fs, path := parseFSURL(inputURL)
+		opts.FS = fs
+		switch {
+		case arguments["--generate"].(bool):
+			yamlfilename = path
+		case arguments["--merge"].(bool):
+			yamlfilename1 = path
+		default:
+			tarfilename = path
+		}
+	}
+	if outputURL, _ := arguments["--output-url"].(string); outputURL != "" {
+		fs, path := parseFSURL(outputURL)
+		opts.FS = fs
+		if arguments["--save"].(bool) {
+			yamlfilename = path
+		} else {
+			newfilename = path
+		}
+	}
+
+	opts.Reproducible = arguments["--reproducible"].(bool)
+	opts.NumericOwner = arguments["--numeric-owner"].(bool)
+	if sourceDateEpoch, _ := arguments["--source-date-epoch"].(string); sourceDateEpoch != "" {
+		epoch, err := strconv.ParseInt(sourceDateEpoch, 10, 64)
+		check(err)
+		opts.SourceDateEpoch = epoch
+	} else if env := os.Getenv("SOURCE_DATE_EPOCH"); env != "" {
+		epoch, err := strconv.ParseInt(env, 10, 64)
+		check(err)
+		opts.SourceDateEpoch = epoch
+	}
 
 	if arguments["--apply"].(bool) {
 		if writeCPIO {
 			// Write a CPIO file
-			check(ApplyMetadataToCpio(tarfilename, yamlfilename, newfilename, force, withBody, root, verbose, skipEmptyFiles))
+			check(ApplyMetadataToCpio(tarfilename, yamlfilename, newfilename, rulesetPath, force, withBody, root, verbose, skipEmptyFiles, overlayWhiteout, compress, opts))
 		} else {
 			// Write a TAR file
-			check(ApplyMetadataToTar(tarfilename, yamlfilename, newfilename, force, withBody, verbose, skipEmptyFiles))
+			check(ApplyMetadataToTar(tarfilename, yamlfilename, newfilename, rulesetPath, force, withBody, verbose, skipEmptyFiles, rawstream, overlayWhiteout, compress, opts))
 		}
 	} else if arguments["--list"].(bool) {
 		// Output contents of tar file
@@ -1592,15 +3982,26 @@ func main() {
 		check(ListCPIO(cpiofilename))
 	} else if arguments["--yaml"].(bool) {
 		// Output YAML metadata
-		check(WriteMetadata(tarfilename, "-", force, withBody, verbose, expand, root, nouser))
+		check(WriteMetadata(tarfilename, "-", force, withBody, verbose, expand, root, nouser, rawstream, "", opts))
 	} else if arguments["--generate"].(bool) {
 		// Convert YAML to tar or cpio, always use "Body:", if present
-		check(ApplyMetadataToTar("", yamlfilename, newfilename, force, true, verbose, skipEmptyFiles))
+		check(ApplyMetadataToTar("", yamlfilename, newfilename, rulesetPath, force, true, verbose, skipEmptyFiles, rawstream, overlayWhiteout, compress, opts))
 	} else if arguments["--merge"].(bool) {
-		check(MergeMetadata(yamlfilename1, yamlfilename2, newfilename, force, verbose))
+		check(MergeMetadata(yamlfilename1, yamlfilename2, newfilename, force, verbose, opts))
+	} else if arguments["--convert"].(bool) {
+		// Convert an archive between tar and cpio/newc format
+		selector, err := NewSelector(orderedSelectorPatterns(os.Args, includePatterns, excludePatterns))
+		check(err)
+		check(ConvertFile(tarfilename, newfilename, force, verbose, format, skipPatterns, selector))
+	} else if v, _ := arguments["--verify"].(bool); v {
+		check(VerifyTar(tarfilename, yamlfilename, verbose))
+	} else if arguments["--oci"].(bool) {
+		check(GenerateOCIImage(layeryamlfilenames, outputdir, rulesetPath, force, verbose, overlayWhiteout))
+	} else if arguments["--diff"].(bool) {
+		check(DiffTars(oldtarfilename, newtarfilename, patchyamlfilename, force, verbose))
 	} else if tarfilename != "" && yamlfilename != "" {
 		// Write a YAML file
-		check(WriteMetadata(tarfilename, yamlfilename, force, withBody, verbose, expand, root, nouser))
+		check(WriteMetadata(tarfilename, yamlfilename, force, withBody, verbose, expand, root, nouser, rawstream, extractBodiesDir, opts))
 	} else {
 		fmt.Println(usage)
 		os.Exit(1)
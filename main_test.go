@@ -1,7 +1,24 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/surma/gocpio"
+	"github.com/xyproto/yaml"
 )
 
 func TestHasList(t *testing.T) {
@@ -35,3 +52,1052 @@ func TestHasGlob(t *testing.T) {
 		t.Error("Wrong: List should match \"kakeeeeee\"")
 	}
 }
+
+// TestRulesetGolden runs a fixture tar's metadata through testdata/rename-rules.yaml
+// and diffs the resulting listing against testdata/rename-rules.golden.
+func TestRulesetGolden(t *testing.T) {
+	rs, err := LoadRuleset("testdata/rename-rules.yaml")
+	if err != nil {
+		t.Fatalf("LoadRuleset: %v", err)
+	}
+
+	entries := []MetaFileRegular{
+		{Filename: "readme.txt", Type: "regular file"},
+		{Filename: "secret/key.pem", Type: "regular file"},
+		{Filename: "bin/run", Type: "regular file"},
+	}
+
+	var lines []string
+	for _, mf := range entries {
+		out, keep := rs.Apply(&mf)
+		if !keep {
+			lines = append(lines, fmt.Sprintf("SKIP %s", mf.Filename))
+			continue
+		}
+		name := out.Filename
+		if out.Rename != "" {
+			name = out.Rename
+		}
+		lines = append(lines, fmt.Sprintf("%s uid=%d gid=%d", name, out.UID, out.GID))
+	}
+	got := strings.Join(lines, "\n") + "\n"
+
+	golden, err := ioutil.ReadFile("testdata/rename-rules.golden")
+	if err != nil {
+		t.Fatalf("reading golden file: %v", err)
+	}
+	if got != string(golden) {
+		t.Errorf("listing mismatch:\ngot:\n%s\nwant:\n%s", got, golden)
+	}
+}
+
+func TestLoadRulesetMissingPattern(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/bad.yaml"
+	if err := ioutil.WriteFile(path, []byte("rules:\n  - rename: \"foo\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadRuleset(path); err == nil {
+		t.Error("expected an error for a rule with no pattern")
+	}
+}
+
+func TestLoadRulesetMissing(t *testing.T) {
+	rs, err := LoadRuleset("testdata/does-not-exist.yaml")
+	if err == nil || rs != nil {
+		t.Error("expected an error and a nil Ruleset for a missing --rules file")
+	}
+}
+
+func TestHasGlobMatrix(t *testing.T) {
+	l := []string{"hei", "du", "der", "kake*", "*ake*"}
+	if !hasGlobMatrix(l, "hei") {
+		t.Error("Wrong: List should match \"hei\"")
+	}
+	if hasGlobMatrix(l, "hello") {
+		t.Error("Wrong: List should not match \"hello\"")
+	}
+	if !hasGlobMatrix(l, "kakeball") {
+		t.Error("Wrong: List should match \"kakeball\"")
+	}
+	if !hasGlobMatrix(l, "kake") {
+		t.Error("Wrong: List should match \"kake\"")
+	}
+	if !hasGlobMatrix(l, "pepperkake") {
+		t.Error("Wrong: List should match \"pepperkake\"")
+	}
+
+	if !hasGlobMatrix([]string{"a?b"}, "axb") {
+		t.Error("Wrong: \"a?b\" should match \"axb\"")
+	}
+	if hasGlobMatrix([]string{"a?b"}, "axxb") {
+		t.Error("Wrong: \"a?b\" should not match \"axxb\" (\"?\" matches exactly one character)")
+	}
+	if hasGlobMatrix([]string{"a?b"}, "ab") {
+		t.Error("Wrong: \"a?b\" should not match \"ab\" (\"?\" requires a character)")
+	}
+
+	if !hasGlobMatrix([]string{"a*b"}, "a/x/b") {
+		t.Error("Wrong: \"a*b\" should match \"a/x/b\" (\"*\" matches \"/\" in the Matrix dialect)")
+	}
+
+	if !hasGlobMatrix([]string{""}, "") {
+		t.Error("Wrong: an empty pattern should match an empty string")
+	}
+	if hasGlobMatrix([]string{""}, "x") {
+		t.Error("Wrong: an empty pattern should not match a non-empty string")
+	}
+	if !hasGlobMatrix([]string{"*"}, "") {
+		t.Error("Wrong: \"*\" should match an empty string")
+	}
+}
+
+func TestMatcherDialects(t *testing.T) {
+	m := Matcher{Dialect: DialectMatrix, Pattern: "a?b"}
+	if !m.Match("axb") {
+		t.Error("Matcher with DialectMatrix should match \"axb\" against \"a?b\"")
+	}
+
+	g := Matcher{Dialect: DialectGlob, Pattern: "a/**/b"}
+	if !g.Match("a/x/y/b") {
+		t.Error("Matcher with DialectGlob should match \"a/x/y/b\" against \"a/**/b\"")
+	}
+}
+
+func TestSelectorNegationPrecedence(t *testing.T) {
+	s, err := NewSelector([]string{"src/**", "!src/vendor/**"})
+	if err != nil {
+		t.Fatalf("NewSelector: %v", err)
+	}
+	if s.Matches("src/main.go") {
+		t.Error("Wrong: \"src/main.go\" should be excluded by \"src/**\"")
+	}
+	if !s.Matches("src/vendor/pkg/file.go") {
+		t.Error("Wrong: \"src/vendor/pkg/file.go\" should be re-included by the later \"!src/vendor/**\"")
+	}
+	if !s.Matches("README.md") {
+		t.Error("Wrong: a path matched by no entry should be kept")
+	}
+}
+
+func TestSelectorLastMatchWins(t *testing.T) {
+	s, err := NewSelector([]string{"!*.go", "main.go"})
+	if err != nil {
+		t.Fatalf("NewSelector: %v", err)
+	}
+	if s.Matches("main.go") {
+		t.Error("Wrong: the later, more specific \"main.go\" entry should win over the earlier \"!*.go\"")
+	}
+	if !s.Matches("other.go") {
+		t.Error("Wrong: \"other.go\" should remain re-included by \"!*.go\"")
+	}
+}
+
+func TestSelectorNoEntries(t *testing.T) {
+	s, err := NewSelector(nil)
+	if err != nil {
+		t.Fatalf("NewSelector: %v", err)
+	}
+	if !s.Matches("anything") {
+		t.Error("Wrong: a Selector with no entries should keep everything")
+	}
+}
+
+func TestSelectorEmptyPattern(t *testing.T) {
+	if _, err := NewSelector([]string{"!"}); err == nil {
+		t.Error("expected an error for a bare \"!\" with an empty pattern")
+	}
+}
+
+func TestSelectorRecursiveGlob(t *testing.T) {
+	s, err := NewSelector([]string{"vendor/**", "!vendor/**/*.go"})
+	if err != nil {
+		t.Fatalf("NewSelector: %v", err)
+	}
+	if s.Matches("vendor/pkg/readme.txt") {
+		t.Error("Wrong: \"vendor/pkg/readme.txt\" should be excluded by \"vendor/**\"")
+	}
+	if !s.Matches("vendor/pkg/sub/file.go") {
+		t.Error("Wrong: \"vendor/pkg/sub/file.go\" should be re-included by \"!vendor/**/*.go\"")
+	}
+}
+
+func TestOrderedSelectorPatterns(t *testing.T) {
+	args := []string{"metatar", "--exclude=vendor/**", "--include=vendor/keep/**", "-x"}
+	patterns := orderedSelectorPatterns(args, []string{"vendor/keep/**"}, []string{"vendor/**"})
+	want := []string{"vendor/**", "!vendor/keep/**"}
+	if len(patterns) != len(want) {
+		t.Fatalf("got %v, want %v", patterns, want)
+	}
+	for i := range want {
+		if patterns[i] != want[i] {
+			t.Errorf("pattern %d: got %q, want %q", i, patterns[i], want[i])
+		}
+	}
+}
+
+func TestOrderedSelectorPatternsSpaceForm(t *testing.T) {
+	// docopt-go also accepts the space-separated long-option form
+	// ("--include foo" instead of "--include=foo"); these must not be
+	// silently dropped.
+	args := []string{"metatar", "--exclude", "vendor/**", "--include", "vendor/keep/**", "-x"}
+	patterns := orderedSelectorPatterns(args, []string{"vendor/keep/**"}, []string{"vendor/**"})
+	want := []string{"vendor/**", "!vendor/keep/**"}
+	if len(patterns) != len(want) {
+		t.Fatalf("got %v, want %v", patterns, want)
+	}
+	for i := range want {
+		if patterns[i] != want[i] {
+			t.Errorf("pattern %d: got %q, want %q", i, patterns[i], want[i])
+		}
+	}
+}
+
+func TestComputeRootDigestStableUnderReorder(t *testing.T) {
+	a := []MetaFileRegular{
+		{Filename: "a.txt", Type: "regular file", Digest: "sha256:aaaa"},
+		{Filename: "b.txt", Type: "regular file", Digest: "sha256:bbbb"},
+	}
+	b := []MetaFileRegular{a[1], a[0]}
+
+	if computeRootDigest(a) != computeRootDigest(b) {
+		t.Error("RootDigest should not depend on the order of Contents")
+	}
+}
+
+func TestComputeRootDigestChangesWithContent(t *testing.T) {
+	a := []MetaFileRegular{{Filename: "a.txt", Type: "regular file", Digest: "sha256:aaaa"}}
+	b := []MetaFileRegular{{Filename: "a.txt", Type: "regular file", Digest: "sha256:cccc"}}
+
+	if computeRootDigest(a) == computeRootDigest(b) {
+		t.Error("RootDigest should change when a file's content digest changes")
+	}
+}
+
+func TestComputeTreeDigestsStableUnderReorder(t *testing.T) {
+	a := []MetaFileRegular{
+		{Filename: "dir/", Type: "directory"},
+		{Filename: "dir/a.txt", Type: "regular file", Digest: "sha256:aaaa"},
+		{Filename: "dir/b.txt", Type: "regular file", Digest: "sha256:bbbb"},
+	}
+	b := []MetaFileRegular{a[2], a[0], a[1]}
+
+	outA := computeTreeDigests(a)
+	outB := computeTreeDigests(b)
+
+	var gotA, gotB string
+	for _, mf := range outA {
+		if mf.Filename == "dir/" {
+			gotA = mf.TreeDigest
+		}
+	}
+	for _, mf := range outB {
+		if mf.Filename == "dir/" {
+			gotB = mf.TreeDigest
+		}
+	}
+	if gotA == "" {
+		t.Fatal("dir/ should have a TreeDigest")
+	}
+	if gotA != gotB {
+		t.Error("TreeDigest should not depend on the order of Contents")
+	}
+}
+
+func TestComputeTreeDigestsChangesWithChildContent(t *testing.T) {
+	withA := []MetaFileRegular{
+		{Filename: "dir/", Type: "directory"},
+		{Filename: "dir/a.txt", Type: "regular file", Digest: "sha256:aaaa"},
+	}
+	withB := []MetaFileRegular{
+		{Filename: "dir/", Type: "directory"},
+		{Filename: "dir/a.txt", Type: "regular file", Digest: "sha256:bbbb"},
+	}
+
+	outA := computeTreeDigests(withA)
+	outB := computeTreeDigests(withB)
+	if outA[0].TreeDigest == outB[0].TreeDigest {
+		t.Error("TreeDigest should change when a child file's content digest changes")
+	}
+}
+
+func TestVerifyTarDetectsTamper(t *testing.T) {
+	dir := t.TempDir()
+
+	writeTar := func(path, body string) {
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		tw := tar.NewWriter(f)
+		hdr := &tar.Header{Name: "a.txt", Mode: 0644, Size: int64(len(body))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	goodTar := dir + "/good.tar"
+	tamperedTar := dir + "/tampered.tar"
+	yamlPath := dir + "/meta.yaml"
+	writeTar(goodTar, "hello\n")
+	writeTar(tamperedTar, "goodbye\n")
+
+	if err := WriteMetadata(goodTar, yamlPath, true, true, false, false, false, false, false, "", DefaultOptions()); err != nil {
+		t.Fatalf("WriteMetadata: %v", err)
+	}
+
+	if err := VerifyTar(goodTar, yamlPath, false); err != nil {
+		t.Errorf("VerifyTar on the original tar should succeed: %v", err)
+	}
+	if err := VerifyTar(tamperedTar, yamlPath, false); err == nil {
+		t.Error("VerifyTar should detect a content change")
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/in.tar"
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	body := "hello\n"
+	if err := tw.WriteHeader(&tar.Header{Name: "a.txt", Mode: 0644, Size: int64(len(body))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	f.Close()
+
+	digest, err := Checksum(path, "a.txt")
+	if err != nil {
+		t.Fatalf("Checksum: %v", err)
+	}
+	if digest != contentDigest([]byte(body)) {
+		t.Errorf("got %s, want %s", digest, contentDigest([]byte(body)))
+	}
+
+	if _, err := Checksum(path, "missing.txt"); err == nil {
+		t.Error("expected an error for a path that isn't in the archive")
+	}
+}
+
+func TestHasGlobRecursive(t *testing.T) {
+	if !hasglob([]string{"a/**/b"}, "a/x/y/b") {
+		t.Error("Wrong: \"a/**/b\" should match \"a/x/y/b\"")
+	}
+	if !hasglob([]string{"a/**/b"}, "a/b") {
+		t.Error("Wrong: \"a/**/b\" should match \"a/b\" (\"**\" can match zero segments)")
+	}
+	if !hasglob([]string{"**/foo"}, "x/y/foo") {
+		t.Error("Wrong: \"**/foo\" should match \"x/y/foo\"")
+	}
+	if !hasglob([]string{"**/foo"}, "foo") {
+		t.Error("Wrong: \"**/foo\" should match \"foo\"")
+	}
+	if !hasglob([]string{"foo/**"}, "foo/bar/baz") {
+		t.Error("Wrong: \"foo/**\" should match \"foo/bar/baz\"")
+	}
+	if !hasglob([]string{"foo/**"}, "foo") {
+		t.Error("Wrong: \"foo/**\" should match \"foo\"")
+	}
+	if !hasglob([]string{"vendor/**/*.go"}, "vendor/pkg/sub/file.go") {
+		t.Error("Wrong: \"vendor/**/*.go\" should match \"vendor/pkg/sub/file.go\"")
+	}
+	if hasglob([]string{"vendor/**/*.go"}, "vendor/pkg/sub/file.txt") {
+		t.Error("Wrong: \"vendor/**/*.go\" should not match \"vendor/pkg/sub/file.txt\"")
+	}
+}
+
+func TestWhiteoutTarget(t *testing.T) {
+	if target, opaque, ok := whiteoutTarget("some/dir/.wh.gone.txt"); !ok || opaque || target != "some/dir/gone.txt" {
+		t.Errorf("got (%q, %v, %v), want (\"some/dir/gone.txt\", false, true)", target, opaque, ok)
+	}
+	if target, opaque, ok := whiteoutTarget("some/dir/.wh..wh..opq"); !ok || !opaque || target != "some/dir" {
+		t.Errorf("got (%q, %v, %v), want (\"some/dir\", true, true)", target, opaque, ok)
+	}
+	if _, _, ok := whiteoutTarget("some/dir/plain.txt"); ok {
+		t.Error("a non-whiteout name should not be recognized as one")
+	}
+}
+
+func TestWriteMetadataFoldsWhiteouts(t *testing.T) {
+	dir := t.TempDir()
+	tarPath := dir + "/in.tar"
+	yamlPath := dir + "/meta.yaml"
+
+	f, err := os.Create(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	entries := []*tar.Header{
+		{Name: "keep.txt", Mode: 0644, Size: 5},
+		{Name: "sub/", Mode: 0755, Typeflag: tar.TypeDir},
+		{Name: "sub/.wh..wh..opq", Mode: 0644},
+		{Name: ".wh.deleted.txt", Mode: 0644},
+	}
+	for _, hdr := range entries {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte("keep\n")[:hdr.Size]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if err := WriteMetadata(tarPath, yamlPath, true, false, false, false, false, false, false, "", DefaultOptions()); err != nil {
+		t.Fatalf("WriteMetadata: %v", err)
+	}
+
+	mfs := MetaArchiveRegular{}
+	yamldata, err := ioutil.ReadFile(yamlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := yaml.Unmarshal(yamldata, &mfs); err != nil {
+		t.Fatal(err)
+	}
+
+	var sub *MetaFileRegular
+	deletedSeen := false
+	for i := range mfs.Contents {
+		mf := &mfs.Contents[i]
+		if strings.TrimSuffix(mf.Filename, "/") == "sub" {
+			sub = mf
+		}
+		if mf.Filename == "deleted.txt" {
+			if !mf.Whiteout {
+				t.Error("deleted.txt should have Whiteout set")
+			}
+			deletedSeen = true
+		}
+	}
+	if sub == nil {
+		t.Fatal("sub/ directory entry not found")
+	}
+	if !sub.OpaqueDir {
+		t.Error("the opaque marker should fold into the existing sub/ directory entry, not a duplicate")
+	}
+	if !deletedSeen {
+		t.Error("deleted.txt whiteout entry not found")
+	}
+}
+
+func TestApplyWhiteoutsAUFS(t *testing.T) {
+	mfs := &MetaArchiveRegular{Contents: []MetaFileRegular{
+		{Filename: "sub/", Type: "directory", OpaqueDir: true},
+		{Filename: "deleted.txt", Type: "regular file", Whiteout: true},
+	}}
+
+	applyWhiteouts(mfs, false)
+
+	var sawMarker, sawOpaque bool
+	for _, mf := range mfs.Contents {
+		if mf.Filename == ".wh.deleted.txt" {
+			sawMarker = true
+		}
+		if mf.Filename == "sub/.wh..wh..opq" {
+			sawOpaque = true
+		}
+	}
+	if !sawMarker {
+		t.Error("expected a .wh.deleted.txt marker file")
+	}
+	if !sawOpaque {
+		t.Error("expected a sub/.wh..wh..opq opaque marker file")
+	}
+}
+
+func TestApplyWhiteoutsOverlay(t *testing.T) {
+	mfs := &MetaArchiveRegular{Contents: []MetaFileRegular{
+		{Filename: "sub/", Type: "directory", OpaqueDir: true},
+		{Filename: "deleted.txt", Type: "regular file", Whiteout: true},
+	}}
+
+	applyWhiteouts(mfs, true)
+
+	if len(mfs.Contents) != 2 {
+		t.Fatalf("overlay style should not add extra entries, got %d", len(mfs.Contents))
+	}
+	if mfs.Contents[1].Type != "character device node" || mfs.Contents[1].Devmajor != 0 || mfs.Contents[1].Devminor != 0 {
+		t.Error("a Whiteout entry should become a 0/0 character device node")
+	}
+	found := false
+	for _, x := range mfs.Contents[0].Xattrs {
+		if x.Key == "trusted.overlay.opaque" && x.Value == "y" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("an OpaqueDir entry should gain a trusted.overlay.opaque=y xattr")
+	}
+}
+
+func TestApplyTransformsSed(t *testing.T) {
+	hdr := &tar.Header{Name: "greet.txt"}
+	specs := []TransformSpec{{Name: "sed", Args: map[string]string{"pattern": "world", "replacement": "metatar"}}}
+
+	out, err := applyTransforms(hdr, []byte("hello world\n"), specs)
+	if err != nil {
+		t.Fatalf("applyTransforms: %v", err)
+	}
+	if string(out) != "hello metatar\n" {
+		t.Errorf("got %q, want %q", out, "hello metatar\n")
+	}
+}
+
+func TestApplyTransformsGzipRoundTrip(t *testing.T) {
+	hdr := &tar.Header{Name: "data.bin"}
+	specs := []TransformSpec{{Name: "gzip"}, {Name: "gunzip"}}
+
+	out, err := applyTransforms(hdr, []byte("payload"), specs)
+	if err != nil {
+		t.Fatalf("applyTransforms: %v", err)
+	}
+	if string(out) != "payload" {
+		t.Errorf("got %q, want %q", out, "payload")
+	}
+}
+
+func TestApplyTransformsRebasePathAndChmod(t *testing.T) {
+	hdr := &tar.Header{Name: "old/greet.txt", Mode: 0644}
+	specs := []TransformSpec{
+		{Name: "rebase-path", Args: map[string]string{"old": "old/", "new": "new/"}},
+		{Name: "chmod", Args: map[string]string{"mode": "0755"}},
+	}
+
+	if _, err := applyTransforms(hdr, []byte("hi"), specs); err != nil {
+		t.Fatalf("applyTransforms: %v", err)
+	}
+	if hdr.Name != "new/greet.txt" {
+		t.Errorf("got Name %q, want %q", hdr.Name, "new/greet.txt")
+	}
+	if hdr.Mode != 0755 {
+		t.Errorf("got Mode %o, want %o", hdr.Mode, 0755)
+	}
+}
+
+func TestApplyTransformsPatch(t *testing.T) {
+	diff := "@@ -1,2 +1,2 @@\n-hello\n+hello there\n world\n"
+	specs := []TransformSpec{{Name: "patch", Args: map[string]string{"diff": diff}}}
+
+	out, err := applyTransforms(&tar.Header{Name: "f.txt"}, []byte("hello\nworld\n"), specs)
+	if err != nil {
+		t.Fatalf("applyTransforms: %v", err)
+	}
+	if string(out) != "hello there\nworld\n" {
+		t.Errorf("got %q, want %q", out, "hello there\nworld\n")
+	}
+}
+
+func TestApplyTransformsPatchMultiHunk(t *testing.T) {
+	// The first hunk removes one line and adds two, shifting every line
+	// below it down by one; the second hunk's "@@ -5,2 +6,2 @@" header is
+	// still expressed in terms of the *original* document, so applying it
+	// correctly requires accounting for that shift.
+	diff := "@@ -1,2 +1,3 @@\n-one\n+one a\n+one b\n two\n@@ -5,2 +6,2 @@\n five\n-six\n+six patched\n"
+	specs := []TransformSpec{{Name: "patch", Args: map[string]string{"diff": diff}}}
+
+	body := []byte("one\ntwo\nthree\nfour\nfive\nsix\nseven\n")
+	out, err := applyTransforms(&tar.Header{Name: "f.txt"}, body, specs)
+	if err != nil {
+		t.Fatalf("applyTransforms: %v", err)
+	}
+	want := "one a\none b\ntwo\nthree\nfour\nfive\nsix patched\nseven\n"
+	if string(out) != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestApplyTransformsUnknownName(t *testing.T) {
+	specs := []TransformSpec{{Name: "no-such-transform"}}
+	if _, err := applyTransforms(&tar.Header{Name: "f.txt"}, []byte("x"), specs); err == nil {
+		t.Error("expected an error for an unregistered transform name")
+	}
+}
+
+func TestApplyMetadataToTarDetectsDigestMismatch(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := dir + "/meta.yaml"
+	newPath := dir + "/out.tar"
+
+	yamldata := `MetaTAR Version: 1.9
+Contents:
+  - Filename: "hello.txt"
+    Type: regular file
+    Mode: 0644
+    Body: aGVsbG8K
+    BodySize: 6
+    Digest: "sha256:0000000000000000000000000000000000000000000000000000000000000"
+`
+	if err := ioutil.WriteFile(yamlPath, []byte(yamldata), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ApplyMetadataToTar("", yamlPath, newPath, "", true, true, false, true, false, false, "", DefaultOptions()); err == nil {
+		t.Error("ApplyMetadataToTar should fail on a Digest mismatch")
+	}
+
+	if err := os.Remove(newPath); err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if err := ApplyMetadataToTar("", yamlPath, newPath, "", true, true, true, true, false, false, "", DefaultOptions()); err != nil {
+		t.Errorf("ApplyMetadataToTar with --verbose should only warn on a Digest mismatch, not fail: %v", err)
+	}
+}
+
+func TestApplyMetadataToTarResolvesFileBodyRef(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := dir + "/meta.yaml"
+	newPath := dir + "/out.tar"
+	payload := "hello from a sidecar\n"
+	if err := ioutil.WriteFile(dir+"/payload.bin", []byte(payload), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	yamldata := fmt.Sprintf(`MetaTAR Version: 1.9
+Contents:
+  - Filename: "hello.txt"
+    Type: regular file
+    Mode: 0644
+    BodyRef: "file:payload.bin"
+    BodySize: %d
+`, len(payload))
+	if err := ioutil.WriteFile(yamlPath, []byte(yamldata), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ApplyMetadataToTar("", yamlPath, newPath, "", true, true, false, true, false, false, "", DefaultOptions()); err != nil {
+		t.Fatalf("ApplyMetadataToTar: %v", err)
+	}
+
+	f, err := os.Open(newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Name != "hello.txt" {
+		t.Errorf("Name = %q, want %q", hdr.Name, "hello.txt")
+	}
+	got, err := io.ReadAll(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != payload {
+		t.Errorf("body = %q, want %q", got, payload)
+	}
+}
+
+func TestWriteMetadataExtractBodies(t *testing.T) {
+	dir := t.TempDir()
+	tarPath := dir + "/in.tar"
+	yamlPath := dir + "/meta.yaml"
+	blobDir := dir + "/blobs-out"
+	body := "extract me\n"
+
+	f, err := os.Create(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	if err := tw.WriteHeader(&tar.Header{Name: "a.txt", Mode: 0644, Size: int64(len(body))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if err := WriteMetadata(tarPath, yamlPath, true, true, false, false, false, false, false, blobDir, DefaultOptions()); err != nil {
+		t.Fatalf("WriteMetadata: %v", err)
+	}
+
+	yamldata, err := ioutil.ReadFile(yamlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(yamldata), "Body:") {
+		t.Errorf("YAML should not contain an inline Body when --extract-bodies is set:\n%s", yamldata)
+	}
+	if !strings.Contains(string(yamldata), "BodyRef: sha256:") {
+		t.Errorf("YAML should contain a BodyRef:\n%s", yamldata)
+	}
+
+	digest := contentDigest([]byte(body))
+	blobPath := filepath.Join(blobDir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+	got, err := ioutil.ReadFile(blobPath)
+	if err != nil {
+		t.Fatalf("blob not found at %s: %v", blobPath, err)
+	}
+	if string(got) != body {
+		t.Errorf("blob contents = %q, want %q", got, body)
+	}
+}
+
+func TestApplyMetadataToTarReproducible(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := dir + "/meta.yaml"
+
+	yamldata := `MetaTAR Version: 1.9
+Contents:
+  - Filename: "zebra.txt"
+    Type: regular file
+    Mode: 0644
+    Body: emVicmE=
+    BodySize: 5
+  - Filename: "apple.txt"
+    Type: regular file
+    Mode: 0644
+    Body: YXBwbGU=
+    BodySize: 5
+`
+	if err := ioutil.WriteFile(yamlPath, []byte(yamldata), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultOptions()
+	opts.Reproducible = true
+	opts.SourceDateEpoch = 1700000000
+	opts.NumericOwner = true
+
+	run := func() []byte {
+		newPath := dir + "/out.tar"
+		if err := os.Remove(newPath); err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		if err := ApplyMetadataToTar("", yamlPath, newPath, "", true, true, false, true, false, false, "", opts); err != nil {
+			t.Fatalf("ApplyMetadataToTar: %v", err)
+		}
+		got, err := ioutil.ReadFile(newPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	first := run()
+	second := run()
+	if !bytes.Equal(first, second) {
+		t.Error("two --reproducible runs over the same input produced different tars")
+	}
+
+	tr := tar.NewReader(bytes.NewReader(first))
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Name != "apple.txt" {
+		t.Errorf("first entry = %q, want %q (sorted filename order)", hdr.Name, "apple.txt")
+	}
+	if hdr.ModTime.Unix() != opts.SourceDateEpoch {
+		t.Errorf("ModTime = %v, want SourceDateEpoch %d", hdr.ModTime, opts.SourceDateEpoch)
+	}
+}
+
+func TestApplyMetadataToCpioReproducible(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := dir + "/meta.yaml"
+
+	yamldata := `MetaTAR Version: 1.9
+Contents:
+  - Filename: "zebra.txt"
+    Type: regular file
+    Mode: 0644
+    Body: emVicmE=
+    BodySize: 5
+  - Filename: "apple.txt"
+    Type: regular file
+    Mode: 0644
+    Body: YXBwbGU=
+    BodySize: 5
+`
+	if err := ioutil.WriteFile(yamlPath, []byte(yamldata), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultOptions()
+	opts.Reproducible = true
+	opts.SourceDateEpoch = 1700000000
+
+	run := func() []byte {
+		newPath := dir + "/out.cpio"
+		if err := os.Remove(newPath); err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		if err := ApplyMetadataToCpio("", yamlPath, newPath, "", true, true, false, false, true, false, "", opts); err != nil {
+			t.Fatalf("ApplyMetadataToCpio: %v", err)
+		}
+		got, err := ioutil.ReadFile(newPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	first := run()
+	second := run()
+	if !bytes.Equal(first, second) {
+		t.Error("two --reproducible runs over the same input produced different cpio archives")
+	}
+
+	gr := cpio.NewReader(bytes.NewReader(first))
+	var names []string
+	for {
+		hdr, err := gr.Next()
+		if err != nil || hdr.Name == "TRAILER!!!" {
+			break
+		}
+		names = append(names, hdr.Name)
+	}
+	if len(names) != 2 || names[0] != "apple.txt" || names[1] != "zebra.txt" {
+		t.Errorf("entries = %v, want [apple.txt zebra.txt] (sorted filename order)", names)
+	}
+
+	// The newc inode number is the 8 hex digits right after the 6-byte
+	// "070701" magic at the start of the first entry's header, which is all
+	// the raw newc format exposes; gocpio's Header doesn't surface it.
+	firstInode := string(first[6:14])
+	if firstInode != "00000001" {
+		t.Errorf("first entry's inode = %q, want %q (--reproducible starts at 1)", firstInode, "00000001")
+	}
+}
+
+func TestGenerateOCIImage(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := dir + "/layer.yaml"
+	yamldata := `MetaTAR Version: 1.9
+History:
+  - CreatedBy: "echo hello"
+Contents:
+  - Filename: "./hello.txt"
+    Type: regular file
+    Mode: 0644
+    Body: aGVsbG8K
+    BodySize: 6
+`
+	if err := ioutil.WriteFile(yamlPath, []byte(yamldata), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	outdir := dir + "/out"
+	if err := GenerateOCIImage([]string{yamlPath}, outdir, "", false, false, false); err != nil {
+		t.Fatalf("GenerateOCIImage: %v", err)
+	}
+
+	indexData, err := ioutil.ReadFile(outdir + "/index.json")
+	if err != nil {
+		t.Fatalf("reading index.json: %v", err)
+	}
+	index := ociIndex{}
+	if err := json.Unmarshal(indexData, &index); err != nil {
+		t.Fatalf("unmarshaling index.json: %v", err)
+	}
+	if len(index.Manifests) != 1 {
+		t.Fatalf("got %d manifests, want 1", len(index.Manifests))
+	}
+	manifestBlob := outdir + "/blobs/sha256/" + strings.TrimPrefix(index.Manifests[0].Digest, "sha256:")
+	manifestData, err := ioutil.ReadFile(manifestBlob)
+	if err != nil {
+		t.Fatalf("reading manifest blob: %v", err)
+	}
+	manifest := ociManifest{}
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		t.Fatalf("unmarshaling manifest: %v", err)
+	}
+	if len(manifest.Layers) != 1 {
+		t.Fatalf("got %d layers, want 1", len(manifest.Layers))
+	}
+
+	layerBlob := outdir + "/blobs/sha256/" + strings.TrimPrefix(manifest.Layers[0].Digest, "sha256:")
+	gzdata, err := ioutil.ReadFile(layerBlob)
+	if err != nil {
+		t.Fatalf("reading layer blob: %v", err)
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(gzdata))
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	tardata, err := io.ReadAll(gr)
+	if err != nil {
+		t.Fatalf("reading decompressed layer: %v", err)
+	}
+	cfgData, err := ioutil.ReadFile(outdir + "/blobs/sha256/" + strings.TrimPrefix(manifest.Config.Digest, "sha256:"))
+	if err != nil {
+		t.Fatalf("reading config blob: %v", err)
+	}
+	cfg := ociConfig{}
+	if err := json.Unmarshal(cfgData, &cfg); err != nil {
+		t.Fatalf("unmarshaling config: %v", err)
+	}
+	if len(cfg.RootFS.DiffIDs) != 1 || cfg.RootFS.DiffIDs[0] != contentDigest(tardata) {
+		t.Errorf("rootfs.diff_ids = %v, want [%s]", cfg.RootFS.DiffIDs, contentDigest(tardata))
+	}
+	if len(cfg.History) != 1 || cfg.History[0].CreatedBy != "echo hello" {
+		t.Errorf("history = %+v, want one entry with CreatedBy %q", cfg.History, "echo hello")
+	}
+}
+
+// writeTestTar writes entries (name -> body, "" for directories) to path as a
+// plain uncompressed tar, in map iteration order via a caller-supplied slice
+// of names so the test controls ordering.
+func writeTestTar(t *testing.T, path string, names []string, bodies map[string]string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	for _, name := range names {
+		body := bodies[name]
+		if strings.HasSuffix(name, "/") {
+			if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeDir}); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func TestDiffTars(t *testing.T) {
+	dir := t.TempDir()
+	oldPath := dir + "/old.tar"
+	newPath := dir + "/new.tar"
+	patchPath := dir + "/patch.yaml"
+
+	writeTestTar(t, oldPath,
+		[]string{"keep.txt", "removed.txt", "replacedir/", "replacedir/a.txt", "keepdir/", "keepdir/b.txt"},
+		map[string]string{"keep.txt": "same\n", "removed.txt": "bye\n", "replacedir/a.txt": "old\n", "keepdir/b.txt": "same\n"})
+
+	writeTestTar(t, newPath,
+		[]string{"keep.txt", "replacedir/", "replacedir/z.txt", "keepdir/", "keepdir/b.txt", "brand.txt"},
+		map[string]string{"keep.txt": "same\n", "replacedir/z.txt": "new\n", "keepdir/b.txt": "same\n", "brand.txt": "new\n"})
+
+	if err := DiffTars(oldPath, newPath, patchPath, true, false); err != nil {
+		t.Fatalf("DiffTars: %v", err)
+	}
+
+	mfs := MetaArchiveRegular{}
+	yamldata, err := ioutil.ReadFile(patchPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := yaml.Unmarshal(yamldata, &mfs); err != nil {
+		t.Fatal(err)
+	}
+
+	byName := make(map[string]MetaFileRegular)
+	for _, mf := range mfs.Contents {
+		byName[strings.TrimSuffix(mf.Filename, "/")] = mf
+	}
+
+	if mf, ok := byName["removed.txt"]; !ok || !mf.Whiteout {
+		t.Error("expected a Whiteout entry for removed.txt")
+	}
+	if _, ok := byName["keep.txt"]; ok {
+		t.Error("keep.txt is unchanged and should not appear in the diff")
+	}
+	if mf, ok := byName["replacedir"]; !ok || !mf.OpaqueDir {
+		t.Error("expected an OpaqueDir entry for replacedir, which was wholesale replaced")
+	}
+	if _, ok := byName["replacedir/a.txt"]; ok {
+		t.Error("replacedir/a.txt is covered by the opaque marker and should not also get its own Whiteout entry")
+	}
+	if mf, ok := byName["replacedir/z.txt"]; !ok || mf.Digest == "" {
+		t.Error("expected a Contents entry with a Digest for the new replacedir/z.txt")
+	} else if got, err := base64.StdEncoding.DecodeString(mf.Body); err != nil || string(got) != "new\n" {
+		t.Errorf("replacedir/z.txt body = %q, %v, want %q", got, err, "new\n")
+	}
+	if mf, ok := byName["brand.txt"]; !ok || mf.Digest == "" {
+		t.Error("expected a Contents entry with a Digest for the new top-level brand.txt")
+	}
+	if mfs.RootDigest != computeRootDigest(mfs.Contents) {
+		t.Error("RootDigest does not match the recomputed digest over Contents")
+	}
+}
+
+func TestResolveBodyRefFileConfinesToYamlDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "body.txt"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := resolveBodyRef("file:body.txt", dir)
+	if err != nil {
+		t.Fatalf("resolveBodyRef: %v", err)
+	}
+	if string(b) != "hello\n" {
+		t.Errorf("body = %q, want %q", b, "hello\n")
+	}
+
+	if _, err := resolveBodyRef("file:../../../../etc/passwd", dir); err == nil {
+		t.Error("expected an error for a BodyRef escaping yamlDir, got nil")
+	}
+	if _, err := resolveBodyRef("file:/etc/passwd", dir); err == nil {
+		t.Error("expected an error for an absolute BodyRef outside yamlDir, got nil")
+	}
+}
+
+func TestResolveBodyRefHTTPTimesOutAndCapsSize(t *testing.T) {
+	blocked := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-blocked
+	}))
+
+	origTimeout := bodyRefHTTPClient.Timeout
+	bodyRefHTTPClient.Timeout = 50 * time.Millisecond
+	defer func() { bodyRefHTTPClient.Timeout = origTimeout }()
+
+	if _, err := resolveBodyRef(slow.URL, t.TempDir()); err == nil {
+		t.Error("expected a timeout error fetching an unresponsive server, got nil")
+	}
+	close(blocked)
+	slow.Close()
+
+	origLimit := maxBodyRefHTTPBytes
+	maxBodyRefHTTPBytes = 16
+	defer func() { maxBodyRefHTTPBytes = origLimit }()
+	big := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, maxBodyRefHTTPBytes+1))
+	}))
+	defer big.Close()
+
+	if _, err := resolveBodyRef(big.URL, t.TempDir()); err == nil {
+		t.Error("expected an error for a response exceeding the size cap, got nil")
+	}
+}
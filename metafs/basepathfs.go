@@ -0,0 +1,76 @@
+package metafs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BasePathFs wraps another FS, transparently prefixing every path with
+// base, the chroot-style confinement afero.BasePathFs provides. A name
+// that would resolve outside of base (e.g. via "../" segments) is rejected
+// rather than joined, so a malicious or buggy path can't escape base.
+type BasePathFs struct {
+	source FS
+	base   string
+}
+
+// NewBasePathFs returns an FS that resolves every path against base before
+// delegating to source.
+func NewBasePathFs(source FS, base string) *BasePathFs {
+	return &BasePathFs{source: source, base: base}
+}
+
+func (b *BasePathFs) resolve(name string) (string, error) {
+	joined := filepath.Join(b.base, name)
+	rel, err := filepath.Rel(filepath.Clean(b.base), joined)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("metafs: %q escapes base path %q", name, b.base)
+	}
+	return joined, nil
+}
+
+func (b *BasePathFs) Open(name string) (File, error) {
+	resolved, err := b.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return b.source.Open(resolved)
+}
+
+func (b *BasePathFs) Create(name string) (File, error) {
+	resolved, err := b.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return b.source.Create(resolved)
+}
+
+func (b *BasePathFs) Stat(name string) (os.FileInfo, error) {
+	resolved, err := b.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return b.source.Stat(resolved)
+}
+
+func (b *BasePathFs) Remove(name string) error {
+	resolved, err := b.resolve(name)
+	if err != nil {
+		return err
+	}
+	return b.source.Remove(resolved)
+}
+
+func (b *BasePathFs) Rename(oldname, newname string) error {
+	resolvedOld, err := b.resolve(oldname)
+	if err != nil {
+		return err
+	}
+	resolvedNew, err := b.resolve(newname)
+	if err != nil {
+		return err
+	}
+	return b.source.Rename(resolvedOld, resolvedNew)
+}
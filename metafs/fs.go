@@ -0,0 +1,52 @@
+// Package metafs provides a small filesystem abstraction, modeled on
+// spf13/afero.Fs, so metatar's core functions can run against archives that
+// live on disk, in memory, or under a chroot-style prefix.
+package metafs
+
+import (
+	"io"
+	"os"
+)
+
+// File is the subset of *os.File that an FS implementation hands back:
+// enough to read or write a whole archive/YAML file and close it afterwards.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Closer
+}
+
+// FS is a minimal filesystem abstraction narrowed to the operations metatar
+// actually needs: opening an existing file for reading, creating (or
+// truncating) one for writing, checking whether a path exists, removing a
+// path, and renaming one path to another.
+type FS interface {
+	Open(name string) (File, error)
+	Create(name string) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Remove(name string) error
+	Rename(oldname, newname string) error
+}
+
+// osFs is the default FS, backed directly by the os package.
+type osFs struct{}
+
+// NewOsFs returns an FS backed by the real filesystem.
+func NewOsFs() FS { return osFs{} }
+
+func (osFs) Open(name string) (File, error)   { return os.Open(name) }
+func (osFs) Create(name string) (File, error) { return os.Create(name) }
+func (osFs) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+func (osFs) Remove(name string) error { return os.Remove(name) }
+func (osFs) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+// Exists reports whether name exists on fsys, the FS-backed equivalent of
+// metatar's os-based exists() helper.
+func Exists(fsys FS, name string) bool {
+	_, err := fsys.Stat(name)
+	return err == nil
+}
@@ -0,0 +1,130 @@
+package metafs
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+// roundTrip writes "hello, metatar\n" to name on fsys, reads it back, and
+// returns the bytes it got.
+func roundTrip(t *testing.T, fsys FS, name string) []byte {
+	t.Helper()
+	w, err := fsys.Create(name)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := w.Write([]byte("hello, metatar\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := fsys.Open(name)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestOsFsRoundTrips(t *testing.T) {
+	dir := t.TempDir()
+	fsys := NewOsFs()
+	name := dir + "/hello.txt"
+
+	got := roundTrip(t, fsys, name)
+	if string(got) != "hello, metatar\n" {
+		t.Errorf("got %q, want %q", got, "hello, metatar\n")
+	}
+	if !Exists(fsys, name) {
+		t.Error("Exists should report true for a file just created")
+	}
+	if err := fsys.Remove(name); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if Exists(fsys, name) {
+		t.Error("Exists should report false after Remove")
+	}
+}
+
+func TestMemMapFsRoundTrips(t *testing.T) {
+	fsys := NewMemMapFs()
+	got := roundTrip(t, fsys, "hello.txt")
+	if string(got) != "hello, metatar\n" {
+		t.Errorf("got %q, want %q", got, "hello, metatar\n")
+	}
+
+	fi, err := fsys.Stat("hello.txt")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if fi.Size() != int64(len("hello, metatar\n")) {
+		t.Errorf("Size() = %d, want %d", fi.Size(), len("hello, metatar\n"))
+	}
+
+	if _, err := fsys.Open("missing.txt"); !os.IsNotExist(err) {
+		t.Errorf("Open of a missing file should return a not-exist error, got %v", err)
+	}
+
+	if err := fsys.Rename("hello.txt", "renamed.txt"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if Exists(fsys, "hello.txt") {
+		t.Error("hello.txt should be gone after Rename")
+	}
+	if !Exists(fsys, "renamed.txt") {
+		t.Error("renamed.txt should exist after Rename")
+	}
+}
+
+func TestBasePathFsConfinesPaths(t *testing.T) {
+	dir := t.TempDir()
+	fsys := NewBasePathFs(NewOsFs(), dir)
+
+	got := roundTrip(t, fsys, "hello.txt")
+	if string(got) != "hello, metatar\n" {
+		t.Errorf("got %q, want %q", got, "hello, metatar\n")
+	}
+
+	// The file should land under dir, not at the bare relative path.
+	if _, err := os.Stat(dir + "/hello.txt"); err != nil {
+		t.Errorf("expected the file under the base path: %v", err)
+	}
+}
+
+func TestBasePathFsRejectsEscape(t *testing.T) {
+	dir := t.TempDir()
+	fsys := NewBasePathFs(NewOsFs(), dir)
+
+	escapes := []string{
+		"../../etc/passwd",
+		"..",
+		"a/../../b",
+	}
+	for _, name := range escapes {
+		if _, err := fsys.Open(name); err == nil {
+			t.Errorf("Open(%q) should be rejected for escaping the base path", name)
+		}
+		if _, err := fsys.Create(name); err == nil {
+			t.Errorf("Create(%q) should be rejected for escaping the base path", name)
+		}
+		if _, err := fsys.Stat(name); err == nil {
+			t.Errorf("Stat(%q) should be rejected for escaping the base path", name)
+		}
+		if err := fsys.Remove(name); err == nil {
+			t.Errorf("Remove(%q) should be rejected for escaping the base path", name)
+		}
+		if err := fsys.Rename(name, "ok.txt"); err == nil {
+			t.Errorf("Rename(%q, ...) should be rejected for escaping the base path", name)
+		}
+		if err := fsys.Rename("ok.txt", name); err == nil {
+			t.Errorf("Rename(..., %q) should be rejected for escaping the base path", name)
+		}
+	}
+}
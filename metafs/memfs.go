@@ -0,0 +1,121 @@
+package metafs
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// memFileInfo is the os.FileInfo implementation backing MemMapFs.Stat.
+type memFileInfo struct {
+	name  string
+	size  int64
+	mtime time.Time
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi memFileInfo) ModTime() time.Time { return fi.mtime }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+// memFile is a MemMapFs entry. Reading is served from a snapshot taken when
+// Open was called; writing accumulates into buf and is only committed back
+// to the owning MemMapFs on Close, the same as writing a real file only
+// becomes visible once it's closed and flushed.
+type memFile struct {
+	fs     *MemMapFs
+	name   string
+	reader *bytes.Reader
+	buf    *bytes.Buffer
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.reader == nil {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrInvalid}
+	}
+	return f.reader.Read(p)
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.buf == nil {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrInvalid}
+	}
+	return f.buf.Write(p)
+}
+
+func (f *memFile) Close() error {
+	if f.buf != nil {
+		f.fs.set(f.name, f.buf.Bytes())
+	}
+	return nil
+}
+
+// MemMapFs is an in-memory FS, for tests and pipelines that shouldn't touch
+// the real filesystem. The zero value is not usable; use NewMemMapFs.
+type MemMapFs struct {
+	mu    sync.RWMutex
+	files map[string][]byte
+}
+
+// NewMemMapFs returns an empty in-memory FS.
+func NewMemMapFs() *MemMapFs {
+	return &MemMapFs{files: make(map[string][]byte)}
+}
+
+func (m *MemMapFs) set(name string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cp := make([]byte, len(data))
+	copy(cp, data)
+	m.files[name] = cp
+}
+
+func (m *MemMapFs) Open(name string) (File, error) {
+	m.mu.RLock()
+	data, ok := m.files[name]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return &memFile{fs: m, name: name, reader: bytes.NewReader(data)}, nil
+}
+
+func (m *MemMapFs) Create(name string) (File, error) {
+	return &memFile{fs: m, name: name, buf: &bytes.Buffer{}}, nil
+}
+
+func (m *MemMapFs) Stat(name string) (os.FileInfo, error) {
+	m.mu.RLock()
+	data, ok := m.files[name]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return memFileInfo{name: path.Base(name), size: int64(len(data))}, nil
+}
+
+func (m *MemMapFs) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *MemMapFs) Rename(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[oldname]
+	if !ok {
+		return &os.PathError{Op: "rename", Path: oldname, Err: os.ErrNotExist}
+	}
+	m.files[newname] = data
+	delete(m.files, oldname)
+	return nil
+}
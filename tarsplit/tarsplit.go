@@ -0,0 +1,237 @@
+// Package tarsplit disassembles a tar stream into an ordered list of
+// segments - raw header/padding/trailer bytes interleaved with references to
+// file payloads - so that the exact byte layout of the original tar
+// (PAX records, GNU long-name headers, block padding, the zero-filled
+// trailer, non-canonical header field encodings, ...) can be reproduced on
+// reassembly instead of being lost by round-tripping through archive/tar.
+//
+// This is the same technique used by the tar-split project: only the file
+// content blocks are candidates for substitution (e.g. after editing a body
+// through the YAML metadata), everything else is replayed byte-for-byte.
+package tarsplit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+)
+
+const blockSize = 512
+
+// SegmentKind identifies what a Segment holds.
+type SegmentKind int
+
+const (
+	// SegmentRaw segments are replayed verbatim: tar headers (including any
+	// GNU long-name/long-link extension headers), block padding, and the
+	// zero-filled trailer.
+	SegmentRaw SegmentKind = iota
+	// SegmentFile segments reference a file's content blocks by name, so the
+	// content can be substituted with a (same-sized) replacement body.
+	SegmentFile
+)
+
+// Segment is one ordered piece of a tar stream.
+type Segment struct {
+	Kind SegmentKind
+	// Raw holds the literal bytes to replay for a SegmentRaw segment, and
+	// the originally-captured content (including its own padding) for a
+	// SegmentFile segment, used as a fallback when no replacement body is
+	// supplied for Name.
+	Raw []byte
+	// Name is the tar entry name a SegmentFile segment's content belongs to.
+	Name string
+	// Size is the content's length in bytes, as declared in the tar header.
+	Size int64
+}
+
+// Stream is a disassembled tar: the ordered segments needed to reassemble it.
+type Stream struct {
+	Segments []Segment
+}
+
+// Disassemble reads a tar byte stream and captures it as an ordered Stream
+// of segments. It parses just enough of each header (the Size and Typeflag
+// fields) to find block boundaries; every other byte is preserved as-is.
+func Disassemble(r io.Reader) (*Stream, error) {
+	s := &Stream{}
+	var zeroBlocks int
+
+	for {
+		block := make([]byte, blockSize)
+		n, err := io.ReadFull(r, block)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		if n < blockSize {
+			// Short final block: keep it verbatim and stop.
+			s.appendRaw(block[:n])
+			break
+		}
+
+		if isZeroBlock(block) {
+			zeroBlocks++
+			s.appendRaw(block)
+			if zeroBlocks >= 2 {
+				// Drain and preserve any trailing record-size padding
+				// (GNU/POSIX tar pads the whole archive to a multiple of
+				// the blocking factor, commonly 10240 bytes).
+				rest, err := io.ReadAll(r)
+				if err != nil {
+					return nil, err
+				}
+				if len(rest) > 0 {
+					s.appendRaw(rest)
+				}
+				return s, nil
+			}
+			continue
+		}
+		zeroBlocks = 0
+
+		size, err := parseOctal(block[124:136])
+		if err != nil {
+			return nil, fmt.Errorf("tarsplit: parsing header size field: %w", err)
+		}
+		typeflag := block[156]
+		name := parseName(block[0:100])
+
+		dataBlocks := int64(0)
+		if size > 0 {
+			dataBlocks = (size + blockSize - 1) / blockSize
+		}
+
+		if dataBlocks == 0 || !isContentTypeflag(typeflag) {
+			// No substitutable content (directory, symlink, device node,
+			// GNU long-name/long-link extension header, PAX record, ...):
+			// keep the header and any data blocks together, verbatim.
+			s.appendRaw(block)
+			if dataBlocks > 0 {
+				data := make([]byte, dataBlocks*blockSize)
+				if _, err := io.ReadFull(r, data); err != nil {
+					return nil, err
+				}
+				s.appendRaw(data)
+			}
+			continue
+		}
+
+		s.appendRaw(block)
+
+		padded := make([]byte, dataBlocks*blockSize)
+		if _, err := io.ReadFull(r, padded); err != nil {
+			return nil, err
+		}
+		s.Segments = append(s.Segments, Segment{
+			Kind: SegmentFile,
+			Raw:  padded,
+			Name: name,
+			Size: size,
+		})
+	}
+
+	return s, nil
+}
+
+func (s *Stream) appendRaw(b []byte) {
+	if n := len(s.Segments); n > 0 && s.Segments[n-1].Kind == SegmentRaw {
+		s.Segments[n-1].Raw = append(s.Segments[n-1].Raw, b...)
+		return
+	}
+	raw := make([]byte, len(b))
+	copy(raw, b)
+	s.Segments = append(s.Segments, Segment{Kind: SegmentRaw, Raw: raw})
+}
+
+// Assemble writes the Stream back out, substituting bodymap[name] for a
+// SegmentFile segment's content when present (and the same length as the
+// originally captured content), and falling back to the captured bytes
+// otherwise. With an empty or nil bodymap, Assemble reproduces the original
+// tar byte-for-byte.
+func (s *Stream) Assemble(w io.Writer, bodymap map[string][]byte) error {
+	for _, seg := range s.Segments {
+		switch seg.Kind {
+		case SegmentRaw:
+			if _, err := w.Write(seg.Raw); err != nil {
+				return err
+			}
+		case SegmentFile:
+			content := seg.Raw
+			if body, ok := bodymap[seg.Name]; ok && int64(len(body)) == seg.Size {
+				padded := make([]byte, len(seg.Raw))
+				copy(padded, body)
+				content = padded
+			}
+			if _, err := w.Write(content); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func isZeroBlock(b []byte) bool {
+	return bytes.Equal(b, make([]byte, blockSize))
+}
+
+// isContentTypeflag reports whether a tar typeflag carries file content that
+// can be looked up by name in a bodymap (regular files, including the
+// obsolete pre-POSIX "regular file (A)" encoding).
+func isContentTypeflag(typeflag byte) bool {
+	return typeflag == '0' || typeflag == '\x00' || typeflag == 'A'
+}
+
+func parseName(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func parseOctal(b []byte) (int64, error) {
+	// GNU tar's base-256 extension (high bit of the first byte set) is used
+	// when a value doesn't fit in the field's octal digits, e.g. file sizes
+	// >= 8GiB.
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		return parseBase256(b)
+	}
+
+	// Trim NUL and space padding, as written by both GNU and POSIX tar.
+	b = bytes.Trim(b, " \x00")
+	if len(b) == 0 {
+		return 0, nil
+	}
+	var v int64
+	for _, c := range b {
+		if c < '0' || c > '7' {
+			return 0, fmt.Errorf("invalid octal digit %q", c)
+		}
+		v = v<<3 + int64(c-'0')
+	}
+	return v, nil
+}
+
+// parseBase256 decodes a GNU tar base-256-encoded numeric header field, the
+// same way Go's archive/tar does: the first byte's high bit is the encoding
+// marker (masked off), and the remaining bits form a big-endian magnitude.
+// tarsplit only needs this to round-trip the Size field without erroring,
+// not to reinterpret it, so a negative encoding (used elsewhere for
+// pre-1970 mtimes) comes back as its unsigned magnitude rather than a
+// negative int64.
+func parseBase256(b []byte) (int64, error) {
+	var x uint64
+	for i, c := range b {
+		if i == 0 {
+			c &= 0x7f
+		}
+		x = x<<8 | uint64(c)
+	}
+	if x > math.MaxInt64 {
+		return 0, fmt.Errorf("tarsplit: base-256 field overflows int64")
+	}
+	return int64(x), nil
+}
@@ -0,0 +1,278 @@
+package tarsplit
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func buildTar(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	files := []struct {
+		name string
+		body string
+	}{
+		{"readme.txt", "hello, world\n"},
+		{"bin/run", "#!/bin/sh\necho hi\n"},
+	}
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.body))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "empty/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func sum(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func TestRoundTripByteIdentical(t *testing.T) {
+	original := buildTar(t)
+
+	stream, err := Disassemble(bytes.NewReader(original))
+	if err != nil {
+		t.Fatalf("Disassemble: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := stream.Assemble(&out, nil); err != nil {
+		t.Fatalf("Assemble: %v", err)
+	}
+
+	if sum(out.Bytes()) != sum(original) {
+		t.Errorf("round-trip is not byte-identical: got %d bytes, want %d bytes", out.Len(), len(original))
+	}
+}
+
+func TestAssembleSubstitutesBody(t *testing.T) {
+	original := buildTar(t)
+
+	stream, err := Disassemble(bytes.NewReader(original))
+	if err != nil {
+		t.Fatalf("Disassemble: %v", err)
+	}
+
+	// Same length as "hello, world\n" (13 bytes) so the header's Size field
+	// still matches the substituted content.
+	replacement := "HELLO, WORLD\n"
+	bodymap := map[string][]byte{"readme.txt": []byte(replacement)}
+
+	var out bytes.Buffer
+	if err := stream.Assemble(&out, bodymap); err != nil {
+		t.Fatalf("Assemble: %v", err)
+	}
+
+	tr := tar.NewReader(&out)
+	found := false
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if hdr.Name != "readme.txt" {
+			continue
+		}
+		found = true
+		var body bytes.Buffer
+		body.ReadFrom(tr)
+		if body.String() != replacement {
+			t.Errorf("got body %q, want %q", body.String(), replacement)
+		}
+	}
+	if !found {
+		t.Fatal("readme.txt not found in reassembled tar")
+	}
+}
+
+// buildGNULongNameTar returns a tar with a name long enough (>100 bytes) to
+// force a GNU long-name (type 'L') extension header ahead of the real one.
+func buildGNULongNameTar(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	name := strings.Repeat("deeply/nested/directory/", 20) + "file-with-a-long-name.txt"
+	body := "hello"
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(body)), Format: tar.FormatGNU}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// buildPAXTar returns a tar with a PAX extended header (type 'x') record
+// ahead of the real one.
+func buildPAXTar(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	hdr := &tar.Header{
+		Name:       "pax/file.txt",
+		Mode:       0644,
+		Size:       5,
+		Format:     tar.FormatPAX,
+		PAXRecords: map[string]string{"metatar.test": "value"},
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRoundTripGNULongName(t *testing.T) {
+	original := buildGNULongNameTar(t)
+
+	stream, err := Disassemble(bytes.NewReader(original))
+	if err != nil {
+		t.Fatalf("Disassemble: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := stream.Assemble(&out, nil); err != nil {
+		t.Fatalf("Assemble: %v", err)
+	}
+
+	if sum(out.Bytes()) != sum(original) {
+		t.Errorf("GNU long-name round-trip is not byte-identical: got %d bytes, want %d bytes", out.Len(), len(original))
+	}
+}
+
+func TestRoundTripPAX(t *testing.T) {
+	original := buildPAXTar(t)
+
+	stream, err := Disassemble(bytes.NewReader(original))
+	if err != nil {
+		t.Fatalf("Disassemble: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := stream.Assemble(&out, nil); err != nil {
+		t.Fatalf("Assemble: %v", err)
+	}
+
+	if sum(out.Bytes()) != sum(original) {
+		t.Errorf("PAX round-trip is not byte-identical: got %d bytes, want %d bytes", out.Len(), len(original))
+	}
+}
+
+func TestParseOctalBase256(t *testing.T) {
+	// A hand-built GNU base-256-encoded Size field (high bit of the first
+	// byte set): the real-world case is a file size >= 8GiB, which doesn't
+	// fit in 11 octal digits, but any value can be encoded this way.
+	field := make([]byte, 12)
+	field[0] = 0x80 // base-256 marker, value 0 in the high bits
+	want := int64(8_589_934_592) // 8GiB
+	for i := 0; i < 5; i++ {
+		field[11-i] = byte(want >> (8 * i))
+	}
+
+	got, err := parseOctal(field)
+	if err != nil {
+		t.Fatalf("parseOctal: %v", err)
+	}
+	if got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+func TestRoundTripBase256Size(t *testing.T) {
+	// A hand-built header using GNU base-256 size encoding instead of
+	// octal, to make sure Disassemble treats it as "preserve byte-for-byte"
+	// rather than erroring on the non-octal digits.
+	block := make([]byte, blockSize)
+	copy(block[0:100], "base256.txt")
+	copy(block[100:108], "0000644\x00")
+	copy(block[108:116], "0000000\x00")
+	copy(block[116:124], "0000000\x00")
+	block[124] = 0x80 // base-256 marker for the Size field
+	block[135] = 5    // Size = 5
+	block[156] = '0'  // regular file
+
+	var chksum int64
+	for i := range block {
+		if i >= 148 && i < 156 {
+			chksum += ' '
+		} else {
+			chksum += int64(block[i])
+		}
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", chksum))
+
+	body := []byte("world")
+	padded := make([]byte, blockSize)
+	copy(padded, body)
+
+	var buf bytes.Buffer
+	buf.Write(block)
+	buf.Write(padded)
+	buf.Write(make([]byte, blockSize*2)) // end-of-archive marker
+
+	original := buf.Bytes()
+	stream, err := Disassemble(bytes.NewReader(original))
+	if err != nil {
+		t.Fatalf("Disassemble: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := stream.Assemble(&out, nil); err != nil {
+		t.Fatalf("Assemble: %v", err)
+	}
+	if sum(out.Bytes()) != sum(original) {
+		t.Error("base-256 size round-trip is not byte-identical")
+	}
+}
+
+func TestAssembleFallsBackOnSizeMismatch(t *testing.T) {
+	original := buildTar(t)
+
+	stream, err := Disassemble(bytes.NewReader(original))
+	if err != nil {
+		t.Fatalf("Disassemble: %v", err)
+	}
+
+	// A replacement of a different length can't be substituted without
+	// rewriting the header's Size field, so Assemble should keep the
+	// original content instead of corrupting the archive.
+	bodymap := map[string][]byte{"readme.txt": []byte("short\n")}
+
+	var out bytes.Buffer
+	if err := stream.Assemble(&out, bodymap); err != nil {
+		t.Fatalf("Assemble: %v", err)
+	}
+
+	if sum(out.Bytes()) != sum(original) {
+		t.Error("Assemble should fall back to the captured content on a body-size mismatch")
+	}
+}